@@ -11,76 +11,581 @@
 package cache
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 )
 
 // DefaultCacheURL is the default Nix binary cache.
 const DefaultCacheURL = "https://cache.nixos.org"
 
-// Cache represents a Nix binary cache.
+// DefaultStoreDir is the store directory substituters must serve.
+const DefaultStoreDir = "/nix/store"
+
+// DefaultPriority is the priority assumed for a substituter whose
+// /nix-cache-info does not specify one. Lower values are tried first.
+const DefaultPriority = 50
+
+const (
+	// DefaultRequestTimeout bounds a single narinfo request, or the wait
+	// for the response headers of a NAR download.
+	DefaultRequestTimeout = 30 * time.Second
+	// DefaultMaxRetries is how many times a transient failure is retried.
+	DefaultMaxRetries = 3
+	// DefaultRetryBackoff is the delay before the first retry; it doubles
+	// after each attempt.
+	DefaultRetryBackoff = 500 * time.Millisecond
+)
+
+// Substituter is a single binary cache queried by Cache.
+type Substituter struct {
+	// URL is an http(s):// or file:// URL. A plain directory path is
+	// accepted too and converted to a file:// URL.
+	URL string
+	// Mirrors are base URLs serving the same nar/ files as URL. They are
+	// recorded in the lockfile as download fallbacks.
+	Mirrors []string
+	// Priority and StoreDir are read from the cache's /nix-cache-info.
+	Priority int
+	StoreDir string
+
+	infoLoaded bool
+}
+
+// Cache represents an ordered set of Nix binary caches.
 type Cache struct {
-	URL    string
-	client *http.Client
+	// URL is the first configured substituter, kept for callers that only
+	// deal with one cache.
+	URL          string
+	substituters []*Substituter
+	client       *http.Client
+
+	// RequestTimeout, MaxRetries and RetryBackoff control each request;
+	// callers bound a whole operation through its context.
+	RequestTimeout time.Duration
+	MaxRetries     int
+	RetryBackoff   time.Duration
+
+	// resolveMu guards resolving substituters, which is retried until it
+	// succeeds once.
+	resolveMu sync.Mutex
+	resolved  bool
+
+	// DiskCache, if set, answers narinfo lookups from disk and records the
+	// results of network lookups.
+	DiskCache *NarInfoDiskCache
+
+	// Credentials, if set, authenticate requests to private caches.
+	Credentials *Credentials
+
+	// Verify, if set, vets each narinfo found. A narinfo it rejects is
+	// passed over, as if that substituter did not have the path, and the
+	// next substituter is tried.
+	Verify func(*NarInfo) error
+
+	// lookups memoizes LookupNarInfo per store hash for the lifetime of the
+	// Cache, so concurrent callers share a single request.
+	mu      sync.Mutex
+	lookups map[string]*lookupCall
 }
 
-// New creates a new Cache client.
+// lookupCall is an in-flight or completed LookupNarInfo.
+type lookupCall struct {
+	done chan struct{}
+	info *NarInfo
+	err  error
+}
+
+// New creates a new Cache client for a single binary cache.
 func New(url string) *Cache {
 	if url == "" {
 		url = DefaultCacheURL
 	}
+	return NewWithSubstituters([]*Substituter{{URL: url}})
+}
+
+// NewWithSubstituters creates a Cache that consults each substituter in
+// priority order, as advertised by its /nix-cache-info. Substituters with
+// equal priority keep the order given.
+func NewWithSubstituters(subs []*Substituter) *Cache {
+	if len(subs) == 0 {
+		subs = []*Substituter{{URL: DefaultCacheURL}}
+	}
+	for _, s := range subs {
+		s.URL = LocalCacheURL(strings.TrimSuffix(s.URL, "/"))
+		for i, m := range s.Mirrors {
+			s.Mirrors[i] = LocalCacheURL(strings.TrimSuffix(m, "/"))
+		}
+	}
+
+	// Closure crawls issue many small requests to the same hosts.
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   DefaultRequestTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 64,
+	}
+	// Local caches go through the same client, so missing files surface as
+	// 404s exactly like they do over HTTP.
+	transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+
 	return &Cache{
-		URL:    strings.TrimSuffix(url, "/"),
-		client: &http.Client{},
+		URL:            subs[0].URL,
+		substituters:   subs,
+		client:         &http.Client{Transport: transport},
+		RequestTimeout: DefaultRequestTimeout,
+		MaxRetries:     DefaultMaxRetries,
+		RetryBackoff:   DefaultRetryBackoff,
+		lookups:        make(map[string]*lookupCall),
+	}
+}
+
+// LocalCacheURL converts a binary cache directory path to a file:// URL.
+// URLs, which contain "://", are returned unchanged.
+func LocalCacheURL(url string) string {
+	if strings.Contains(url, "://") {
+		return url
+	}
+	if abs, err := filepath.Abs(url); err == nil {
+		url = abs
 	}
+	return "file://" + filepath.ToSlash(url)
 }
 
-// LookupNarInfo fetches the .narinfo for a given store path hash.
-// Returns nil, nil if the path is not in the cache.
+// IsSupportedCacheURL reports whether url names a binary cache Cache can
+// query: an http(s):// or file:// URL, or an absolute directory. Other Nix
+// store URLs, such as daemon or s3://, are not supported.
+func IsSupportedCacheURL(url string) bool {
+	for _, scheme := range []string{"http://", "https://", "file://"} {
+		if strings.HasPrefix(url, scheme) {
+			return true
+		}
+	}
+	return filepath.IsAbs(url)
+}
+
+// isLocal reports whether s is a file:// cache.
+func (s *Substituter) isLocal() bool {
+	return strings.HasPrefix(s.URL, "file://")
+}
+
+// Substituters returns the usable substituters in the order they are tried.
+func (c *Cache) Substituters() ([]*Substituter, error) {
+	return c.SubstitutersContext(context.Background())
+}
+
+// SubstitutersContext is like Substituters but fetches /nix-cache-info
+// within ctx. A substituter whose /nix-cache-info cannot be fetched is left
+// out, and retried by the next call; it is an error only if none can be
+// fetched.
+func (c *Cache) SubstitutersContext(ctx context.Context) ([]*Substituter, error) {
+	c.resolveMu.Lock()
+	defer c.resolveMu.Unlock()
+	if c.resolved {
+		return c.substituters, nil
+	}
+
+	var usable []*Substituter
+	var errs []error
+	for _, s := range c.substituters {
+		if err := c.loadCacheInfo(ctx, s); err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		if s.StoreDir != DefaultStoreDir {
+			// Paths from another store directory cannot be mounted at
+			// /nix/store, so Nix refuses such caches too.
+			continue
+		}
+		usable = append(usable, s)
+	}
+	if len(usable) == 0 && len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	sort.SliceStable(usable, func(i, j int) bool {
+		return usable[i].Priority < usable[j].Priority
+	})
+	if len(errs) > 0 {
+		return usable, nil
+	}
+	c.substituters = usable
+	c.resolved = true
+	return c.substituters, nil
+}
+
+// loadCacheInfo reads StoreDir and Priority from <url>/nix-cache-info.
+func (c *Cache) loadCacheInfo(ctx context.Context, s *Substituter) error {
+	if s.infoLoaded {
+		return nil
+	}
+	priority, storeDir := DefaultPriority, DefaultStoreDir
+
+	body, err := c.fetch(ctx, s.URL+"/nix-cache-info")
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return err
+	}
+
+	for _, line := range strings.Split(string(body), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "StoreDir":
+			storeDir = value
+		case "Priority":
+			fmt.Sscanf(value, "%d", &priority)
+		}
+	}
+	s.Priority, s.StoreDir = priority, storeDir
+	s.infoLoaded = true
+	return nil
+}
+
+// LookupNarInfo fetches the .narinfo for a given store path hash from the
+// first substituter that has it, recording that substituter in the result.
+// Returns nil, nil if the path is not in any cache.
+//
+// Results are memoized, and concurrent lookups of the same hash share one
+// request. Callers must not modify the returned NarInfo.
 func (c *Cache) LookupNarInfo(storeHash string) (*NarInfo, error) {
-	url := fmt.Sprintf("%s/%s.narinfo", c.URL, storeHash)
-	resp, err := c.client.Get(url)
+	return c.LookupNarInfoContext(context.Background(), storeHash)
+}
+
+// LookupNarInfoContext is like LookupNarInfo but gives up when ctx is done.
+// Failures that persisted through every retry are *TransientError; a
+// narinfo for the wrong store path is a *HashMismatchError.
+func (c *Cache) LookupNarInfoContext(ctx context.Context, storeHash string) (*NarInfo, error) {
+	c.mu.Lock()
+	if call, ok := c.lookups[storeHash]; ok {
+		c.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.info, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	c.lookups[storeHash] = call
+	c.mu.Unlock()
+
+	call.info, call.err = c.lookupNarInfoUncached(ctx, storeHash)
+	if call.err != nil {
+		// Let later callers retry transient failures.
+		c.mu.Lock()
+		delete(c.lookups, storeHash)
+		c.mu.Unlock()
+	}
+	close(call.done)
+	return call.info, call.err
+}
+
+// lookupNarInfoUncached tries each substituter in turn. One that fails is
+// passed over, but since it might have had the path, a miss everywhere else
+// is then reported as its error rather than as not found.
+func (c *Cache) lookupNarInfoUncached(ctx context.Context, storeHash string) (*NarInfo, error) {
+	subs, err := c.SubstitutersContext(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch narinfo: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
+	var errs []error
+	for _, s := range subs {
+		info, err := c.lookupNarInfo(ctx, s, storeHash)
+		if err == nil && info != nil {
+			info.CacheURL = s.URL
+			info.Mirrors = s.Mirrors
+			if c.Verify != nil {
+				err = c.Verify(info)
+			}
+			if err == nil {
+				return info, nil
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			errs = append(errs, err)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
 
-	if resp.StatusCode == http.StatusNotFound {
-		return nil, nil // Not in cache
+func (c *Cache) lookupNarInfo(ctx context.Context, s *Substituter, storeHash string) (*NarInfo, error) {
+	body, found, err := c.fetchNarInfo(ctx, s, storeHash)
+	if err != nil || !found {
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected status %d for %s", resp.StatusCode, url)
+
+	info, err := ParseNarInfo(body)
+	if err != nil {
+		return nil, err
+	}
+	if got := StoreHash(info.StorePath); got != storeHash {
+		return nil, fmt.Errorf("narinfo from %s: %w", s.URL, &HashMismatchError{
+			What:     "store path hash",
+			Expected: storeHash,
+			Actual:   got,
+		})
+	}
+	return info, nil
+}
+
+// fetchNarInfo returns the raw narinfo text for storeHash, consulting the
+// disk cache first when one is configured.
+func (c *Cache) fetchNarInfo(ctx context.Context, s *Substituter, storeHash string) (string, bool, error) {
+	diskCache := c.diskCacheFor(s)
+	if diskCache != nil {
+		if body, found := diskCache.Get(s.URL, storeHash); found {
+			return body, body != "", nil
+		}
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	body, err := c.fetch(ctx, fmt.Sprintf("%s/%s.narinfo", s.URL, storeHash))
+	if errors.Is(err, ErrNotFound) {
+		// Not in cache. A failure to record this only costs a refetch.
+		if diskCache != nil {
+			diskCache.PutNegative(s.URL, storeHash)
+		}
+		return "", false, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to read narinfo: %w", err)
+		return "", false, err
 	}
 
-	return ParseNarInfo(string(body))
+	if diskCache != nil {
+		if _, err := ParseNarInfo(string(body)); err == nil {
+			diskCache.PutPositive(s.URL, storeHash, string(body))
+		}
+	}
+	return string(body), true, nil
+}
+
+// diskCacheFor returns the disk cache to use for s. Local caches are cheap
+// to read and may gain entries at any time, so they are never cached.
+func (c *Cache) diskCacheFor(s *Substituter) *NarInfoDiskCache {
+	if s.isLocal() {
+		return nil
+	}
+	return c.DiskCache
 }
 
-// DownloadNar downloads a NAR file and returns a reader.
+// DownloadNar downloads a NAR file and returns a reader. narPath is either
+// an absolute URL or a path relative to the cache root, in which case each
+// substituter is tried in order.
 func (c *Cache) DownloadNar(narPath string) (io.ReadCloser, error) {
-	url := fmt.Sprintf("%s/%s", c.URL, narPath)
-	resp, err := c.client.Get(url)
+	return c.DownloadNarContext(context.Background(), narPath)
+}
+
+// DownloadNarContext is like DownloadNar, but the download is abandoned
+// when ctx is done, including while the returned reader is being read. If
+// no substituter has the file the error wraps ErrNotFound.
+func (c *Cache) DownloadNarContext(ctx context.Context, narPath string) (io.ReadCloser, error) {
+	if strings.Contains(narPath, "://") {
+		return c.open(ctx, narPath)
+	}
+	subs, err := c.SubstitutersContext(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download NAR: %w", err)
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("unexpected status %d for %s", resp.StatusCode, url)
+	var lastErr error
+	for _, s := range subs {
+		body, err := c.open(ctx, fmt.Sprintf("%s/%s", s.URL, narPath))
+		if err == nil {
+			return body, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		lastErr = err
 	}
-	return resp.Body, nil
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no substituters configured")
+	}
+	return nil, lastErr
 }
 
-// IsCached checks if a store path is available in the cache.
+// IsCached checks if a store path is available in the cache. Unlike
+// LookupNarInfo it only needs a HEAD request per substituter, and it reuses
+// any narinfo already fetched or cached on disk.
 func (c *Cache) IsCached(storeHash string) (bool, error) {
-	info, err := c.LookupNarInfo(storeHash)
+	return c.IsCachedContext(context.Background(), storeHash)
+}
+
+// IsCachedContext is like IsCached but gives up when ctx is done.
+func (c *Cache) IsCachedContext(ctx context.Context, storeHash string) (bool, error) {
+	c.mu.Lock()
+	call, ok := c.lookups[storeHash]
+	c.mu.Unlock()
+	if ok {
+		select {
+		case <-call.done:
+			if call.err == nil {
+				return call.info != nil, nil
+			}
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	subs, err := c.SubstitutersContext(ctx)
 	if err != nil {
 		return false, err
 	}
-	return info != nil, nil
+	var errs []error
+	for _, s := range subs {
+		if diskCache := c.diskCacheFor(s); diskCache != nil {
+			if body, found := diskCache.Get(s.URL, storeHash); found {
+				if body != "" {
+					return true, nil
+				}
+				continue
+			}
+		}
+
+		err := c.head(ctx, fmt.Sprintf("%s/%s.narinfo", s.URL, storeHash))
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return false, err
+			}
+			errs = append(errs, err)
+			continue
+		}
+		return true, nil
+	}
+	return false, errors.Join(errs...)
+}
+
+// fetch GETs a small file such as a narinfo, reading the whole body within
+// one attempt so a stalled transfer is retried too.
+func (c *Cache) fetch(ctx context.Context, url string) ([]byte, error) {
+	var body []byte
+	err := c.retry(ctx, url, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+		resp, err := c.send(ctx, http.MethodGet, url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if err := checkStatus(resp, url); err != nil {
+			return err
+		}
+		r, err := decodeContent(resp)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		body, err = io.ReadAll(r)
+		return err
+	})
+	return body, err
+}
+
+// head checks that url exists.
+func (c *Cache) head(ctx context.Context, url string) error {
+	return c.retry(ctx, url, func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, c.RequestTimeout)
+		defer cancel()
+		resp, err := c.send(ctx, http.MethodHead, url)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return checkStatus(resp, url)
+	})
+}
+
+// open starts a download. Only the wait for response headers is bounded by
+// RequestTimeout, since NARs can take arbitrarily long to transfer.
+func (c *Cache) open(ctx context.Context, url string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := c.retry(ctx, url, func(ctx context.Context) error {
+		ctx, cancel := context.WithCancel(ctx)
+		timer := time.AfterFunc(c.RequestTimeout, cancel)
+		resp, err := c.send(ctx, http.MethodGet, url)
+		if !timer.Stop() && err == nil {
+			// The timeout fired just as the headers arrived.
+			resp.Body.Close()
+			err = context.DeadlineExceeded
+		}
+		if err != nil {
+			cancel()
+			return err
+		}
+		if err := checkStatus(resp, url); err != nil {
+			resp.Body.Close()
+			cancel()
+			return err
+		}
+		body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download NAR: %w", err)
+	}
+	return body, nil
+}
+
+// send issues one authenticated request.
+func (c *Cache) send(ctx context.Context, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.Credentials.authorize(req)
+	return c.client.Do(req)
+}
+
+// retry runs attempt until it succeeds or fails permanently, backing off
+// exponentially between attempts. A failure that is still transient after
+// MaxRetries retries is returned as a *TransientError.
+func (c *Cache) retry(ctx context.Context, url string, attempt func(context.Context) error) error {
+	backoff := c.RetryBackoff
+	for i := 0; ; i++ {
+		err := attempt(ctx)
+		if err == nil || !retryable(ctx, err) {
+			return err
+		}
+		if i >= c.MaxRetries {
+			return &TransientError{URL: url, Err: err}
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// cancelOnClose releases a download's context once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
@@ -0,0 +1,314 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testHash = "i3zw7h6pg3n9r5i63iyqxrapa70i4v5w"
+
+// newTestCache serves a binary cache with the given nix-cache-info priority
+// and, if hasPath is set, a narinfo for testHash.
+func newTestCache(t *testing.T, priority int, hasPath bool) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/nix-cache-info":
+			fmt.Fprintf(w, "StoreDir: /nix/store\nWantMassQuery: 1\nPriority: %d\n", priority)
+		case "/" + testHash + ".narinfo":
+			if !hasPath {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprintf(w, "StorePath: /nix/store/%s-hello-2.12.2\nURL: nar/abc.nar.zst\nCompression: zstd\n", testHash)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLookupNarInfoPriority(t *testing.T) {
+	low := newTestCache(t, 40, true)
+	high := newTestCache(t, 10, true)
+	missing := newTestCache(t, 1, false)
+
+	c := NewWithSubstituters([]*Substituter{
+		{URL: low.URL},
+		{URL: high.URL, Mirrors: []string{"https://mirror.example/"}},
+		{URL: missing.URL},
+	})
+	info, err := c.LookupNarInfo(testHash)
+	if err != nil {
+		t.Fatalf("LookupNarInfo: %v", err)
+	}
+	if info == nil {
+		t.Fatal("LookupNarInfo returned nil")
+	}
+	if info.CacheURL != high.URL {
+		t.Errorf("CacheURL = %q; want highest-priority cache %q", info.CacheURL, high.URL)
+	}
+
+	lf := &LockFile{}
+	if err := lf.AddStorePath(info); err != nil {
+		t.Fatalf("AddStorePath: %v", err)
+	}
+	entry := lf.StorePaths[info.StorePath]
+	if want := high.URL + "/nar/abc.nar.zst"; entry.NarURL != want {
+		t.Errorf("NarURL = %q; want %q", entry.NarURL, want)
+	}
+	if len(entry.MirrorURLs) != 1 || entry.MirrorURLs[0] != "https://mirror.example/nar/abc.nar.zst" {
+		t.Errorf("MirrorURLs = %v", entry.MirrorURLs)
+	}
+}
+
+func TestLookupNarInfoDiskCache(t *testing.T) {
+	var narinfoRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/" + testHash + ".narinfo":
+			narinfoRequests++
+			fmt.Fprintf(w, "StorePath: /nix/store/%s-hello-2.12.2\nURL: nar/abc.nar.xz\nCompression: xz\n", testHash)
+		default:
+			narinfoRequests++
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	disk := NewNarInfoDiskCache(t.TempDir())
+	for i := 0; i < 2; i++ {
+		// A fresh client each time, as in separate Gazelle runs.
+		c := New(srv.URL)
+		c.DiskCache = disk
+		if info, err := c.LookupNarInfo(testHash); err != nil || info == nil {
+			t.Fatalf("LookupNarInfo(%s) = %v, %v", testHash, info, err)
+		}
+		if info, err := c.LookupNarInfo("00000000000000000000000000000000"); err != nil || info != nil {
+			t.Fatalf("LookupNarInfo(missing) = %v, %v; want nil, nil", info, err)
+		}
+	}
+	// One nix-cache-info request per client, plus one request per store
+	// hash on the first pass only.
+	if narinfoRequests != 4 {
+		t.Errorf("server saw %d requests; want 4", narinfoRequests)
+	}
+}
+
+func TestNarInfoDiskCacheIgnoresTruncatedEntry(t *testing.T) {
+	disk := NewNarInfoDiskCache(t.TempDir())
+	if err := disk.PutPositive("https://cache.example", testHash, "StorePath: x\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := disk.Get("https://cache.example", testHash); !found {
+		t.Fatal("entry not found after PutPositive")
+	}
+	// Entries are not synced, so a crash can leave them empty.
+	if err := os.Truncate(disk.entryPath("https://cache.example", testHash, ".narinfo"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if content, found := disk.Get("https://cache.example", testHash); found {
+		t.Errorf("Get of an empty entry = %q, true; want a miss", content)
+	}
+}
+
+func TestLocalCache(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(src, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	cacheDir := filepath.Join(root, "vendor", "nix-cache")
+	published, err := Publish(cacheDir, testSelf, src, PublishOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A plain directory and its file:// URL name the same cache.
+	for _, url := range []string{cacheDir, "file://" + cacheDir} {
+		c := New(url)
+		c.DiskCache = NewNarInfoDiskCache(t.TempDir())
+
+		info, err := c.LookupNarInfo(StoreHash(testSelf))
+		if err != nil || info == nil {
+			t.Fatalf("%s: LookupNarInfo = %v, %v", url, info, err)
+		}
+		if info.CacheURL != "file://"+cacheDir {
+			t.Errorf("%s: CacheURL = %q", url, info.CacheURL)
+		}
+		if ok, err := c.IsCached(StoreHash(testDep)); err != nil || ok {
+			t.Errorf("%s: IsCached(missing) = %v, %v; want false", url, ok, err)
+		}
+
+		body, err := c.DownloadNar(info.URL)
+		if err != nil {
+			t.Fatalf("%s: DownloadNar: %v", url, err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil || int64(len(data)) != published.FileSize {
+			t.Errorf("%s: downloaded %d bytes, %v; want %d", url, len(data), err, published.FileSize)
+		}
+
+		lf := &LockFile{Root: root}
+		if err := lf.AddStorePath(info); err != nil {
+			t.Fatalf("%s: AddStorePath: %v", url, err)
+		}
+		if got, want := lf.StorePaths[testSelf].NarURL, "vendor/nix-cache/"+info.URL; got != want {
+			t.Errorf("%s: NarURL = %q; want %q", url, got, want)
+		}
+		fileHash, _ := ParseHash(info.FileHash)
+		if got := lf.StorePaths[testSelf].Integrity; got != fileHash.SRI() {
+			t.Errorf("%s: Integrity = %q; want %q", url, got, fileHash.SRI())
+		}
+	}
+
+	// Entries published after a miss are seen at once; local caches bypass
+	// the disk cache.
+	c := New(cacheDir)
+	c.DiskCache = NewNarInfoDiskCache(t.TempDir())
+	if ok, _ := c.IsCached(StoreHash(testDep)); ok {
+		t.Fatal("IsCached before publishing = true")
+	}
+	if _, err := Publish(cacheDir, testDep, src, PublishOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := New(cacheDir).IsCached(StoreHash(testDep)); err != nil || !ok {
+		t.Errorf("IsCached after publishing = %v, %v; want true", ok, err)
+	}
+	if info, err := c.LookupNarInfo(StoreHash(testDep)); err != nil || info == nil {
+		t.Errorf("LookupNarInfo after publishing = %v, %v", info, err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var failures, requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch {
+		case r.URL.Path == "/nix-cache-info":
+			http.NotFound(w, r)
+		case r.URL.Path == "/slow.narinfo":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		case failures > 0:
+			failures--
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		case r.URL.Path == "/"+testHash+".narinfo":
+			fmt.Fprintf(w, "StorePath: /nix/store/%s-hello\nURL: nar/x.nar\n", testHash)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	newCache := func() *Cache {
+		c := New(srv.URL)
+		c.RetryBackoff = time.Millisecond
+		c.RequestTimeout = 100 * time.Millisecond
+		return c
+	}
+
+	failures = 2
+	if info, err := newCache().LookupNarInfo(testHash); err != nil || info == nil {
+		t.Errorf("LookupNarInfo after two 503s = %v, %v", info, err)
+	}
+
+	failures = 100
+	requests = 0
+	_, err := newCache().LookupNarInfo(testHash)
+	if !IsTransient(err) {
+		t.Errorf("LookupNarInfo with a failing cache = %v; want a TransientError", err)
+	}
+	// nix-cache-info, then one attempt plus DefaultMaxRetries retries.
+	if want := 2 + DefaultMaxRetries; requests != want {
+		t.Errorf("server saw %d requests; want %d", requests, want)
+	}
+	failures = 0
+
+	if _, err := newCache().LookupNarInfo("slow"); !IsTransient(err) {
+		t.Errorf("LookupNarInfo of a hung request = %v; want a TransientError", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c := newCache()
+	c.RequestTimeout = time.Minute
+	if _, err := c.LookupNarInfoContext(ctx, "slow"); !errors.Is(err, context.DeadlineExceeded) || IsTransient(err) {
+		t.Errorf("LookupNarInfoContext past its deadline = %v; want DeadlineExceeded", err)
+	}
+
+	if _, err := newCache().DownloadNar("nar/missing.nar"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DownloadNar of a missing file = %v; want ErrNotFound", err)
+	}
+}
+
+func TestLookupNarInfoFallsThrough(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	first := newTestCache(t, 10, true)
+	second := newTestCache(t, 20, true)
+
+	c := NewWithSubstituters([]*Substituter{{URL: down.URL}, {URL: first.URL}, {URL: second.URL}})
+	c.MaxRetries = 0
+	c.Verify = func(info *NarInfo) error {
+		if info.CacheURL == first.URL {
+			return errors.New("untrusted")
+		}
+		return nil
+	}
+	info, err := c.LookupNarInfo(testHash)
+	if err != nil || info == nil {
+		t.Fatalf("LookupNarInfo = %v, %v", info, err)
+	}
+	if info.CacheURL != second.URL {
+		t.Errorf("CacheURL = %q; want the only trusted cache %q", info.CacheURL, second.URL)
+	}
+	if cached, err := c.IsCached(testHash); err != nil || !cached {
+		t.Errorf("IsCached = %v, %v; want true", cached, err)
+	}
+
+	// With nothing trusted, the rejection is reported rather than a miss.
+	c = NewWithSubstituters([]*Substituter{{URL: first.URL}})
+	c.Verify = func(*NarInfo) error { return errors.New("untrusted") }
+	if info, err := c.LookupNarInfo(testHash); err == nil {
+		t.Errorf("LookupNarInfo with only untrusted narinfo = %v, nil; want an error", info)
+	}
+
+	c = NewWithSubstituters([]*Substituter{{URL: down.URL}})
+	c.MaxRetries = 0
+	if _, err := c.LookupNarInfo(testHash); !IsTransient(err) {
+		t.Errorf("LookupNarInfo with every cache down = %v; want a TransientError", err)
+	}
+}
+
+func TestInvalidHashes(t *testing.T) {
+	const narinfo = "StorePath: /nix/store/%s-hello\nURL: nar/x.nar\n%s: sha256:not-a-hash\n"
+	for _, field := range []string{"FileHash", "NarHash"} {
+		if info, err := ParseNarInfo(fmt.Sprintf(narinfo, testHash, field)); err == nil {
+			t.Errorf("ParseNarInfo with an invalid %s = %+v; want an error", field, info)
+		}
+	}
+
+	lf := &LockFile{}
+	info := &NarInfo{StorePath: "/nix/store/" + testHash + "-hello", URL: "nar/x.nar", FileHash: "sha256:not-a-hash"}
+	if err := lf.AddStorePath(info); err == nil {
+		t.Error("AddStorePath with an invalid FileHash succeeded")
+	}
+	if len(lf.StorePaths) != 0 {
+		t.Errorf("AddStorePath recorded %v; want nothing", lf.StorePaths)
+	}
+}
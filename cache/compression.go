@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sorairolake/lzip-go"
+	"github.com/ulikunitz/xz"
+)
+
+// Compressions lists the NAR compression methods understood by
+// NewDecompressor. The names match the Compression field Nix writes into
+// .narinfo files.
+var Compressions = []string{"none", "xz", "bzip2", "zstd", "gzip", "br", "lzip"}
+
+// DefaultCompression is the compression Nix assumes when a .narinfo has no
+// Compression field.
+const DefaultCompression = "bzip2"
+
+// NewDecompressor wraps r in a streaming decoder for the given compression
+// method. The returned reader must be closed to release decoder resources;
+// closing it does not close r.
+func NewDecompressor(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case "none", "":
+		return io.NopCloser(r), nil
+	case "xz":
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create xz reader: %w", err)
+		}
+		return io.NopCloser(xr), nil
+	case "bzip2":
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	case "zstd":
+		zr, err := zstd.NewReader(r, zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gr, nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "lzip":
+		lr, err := lzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create lzip reader: %w", err)
+		}
+		return io.NopCloser(lr), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression: %s", compression)
+	}
+}
+
+// CompressionExtension returns the file extension Nix uses for NARs with the
+// given compression (e.g. ".xz" for "nar/<hash>.nar.xz").
+func CompressionExtension(compression string) string {
+	switch compression {
+	case "xz":
+		return ".xz"
+	case "bzip2":
+		return ".bz2"
+	case "zstd":
+		return ".zst"
+	case "gzip":
+		return ".gz"
+	case "br":
+		return ".br"
+	case "lzip":
+		return ".lz"
+	default:
+		return ""
+	}
+}
+
+// NewCompressor wraps w in a streaming encoder for the given compression
+// method. Closing the returned writer flushes the encoder but does not close
+// w. Nix can read bzip2 NARs but the standard library cannot write them, so
+// bzip2 is not supported here.
+func NewCompressor(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case "none", "":
+		return nopWriteCloser{w}, nil
+	case "xz":
+		xw, err := xz.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create xz writer: %w", err)
+		}
+		return xw, nil
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+		}
+		return zw, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "br":
+		return brotli.NewWriter(w), nil
+	case "lzip":
+		return lzip.NewWriter(w), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression for writing: %s", compression)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// decodeContent undoes a Content-Encoding the HTTP transport did not
+// handle itself. Binary caches commonly serve .ls listings this way.
+func decodeContent(resp *http.Response) (io.ReadCloser, error) {
+	switch enc := resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return io.NopCloser(resp.Body), nil
+	case "x-gzip":
+		return NewDecompressor(resp.Body, "gzip")
+	case "gzip", "br", "xz", "zstd", "bzip2":
+		return NewDecompressor(resp.Body, enc)
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", enc)
+	}
+}
@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+)
+
+// NetrcEntry is one machine (or the default) in a netrc file.
+type NetrcEntry struct {
+	Machine  string // empty for the default entry
+	Login    string
+	Password string
+}
+
+// Credentials authenticates requests to private binary caches, as Nix does
+// with its netrc-file and access-tokens settings.
+type Credentials struct {
+	Netrc []NetrcEntry
+	// AccessTokens maps a host, or host/path prefix, to a bearer token.
+	AccessTokens map[string]string
+}
+
+// ParseNetrc parses the contents of a netrc file. Macro definitions are
+// skipped.
+func ParseNetrc(content string) []NetrcEntry {
+	var entries []NetrcEntry
+	var cur *NetrcEntry
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		for j := 0; j < len(fields); j++ {
+			next := func() string {
+				if j+1 < len(fields) {
+					j++
+					return fields[j]
+				}
+				return ""
+			}
+			switch fields[j] {
+			case "machine":
+				entries = append(entries, NetrcEntry{Machine: next()})
+				cur = &entries[len(entries)-1]
+			case "default":
+				entries = append(entries, NetrcEntry{})
+				cur = &entries[len(entries)-1]
+			case "login":
+				if v := next(); cur != nil {
+					cur.Login = v
+				}
+			case "password":
+				if v := next(); cur != nil {
+					cur.Password = v
+				}
+			case "account":
+				next()
+			case "macdef":
+				// The macro body runs up to the next blank line.
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			}
+		}
+	}
+	return entries
+}
+
+// authorize adds credentials for req's host, if any. A netrc entry for
+// the host wins over an access token, which wins over the netrc default.
+func (c *Credentials) authorize(req *http.Request) {
+	if c == nil {
+		return
+	}
+	host := req.URL.Hostname()
+	var fallback *NetrcEntry
+	for i, e := range c.Netrc {
+		switch e.Machine {
+		case host:
+			req.SetBasicAuth(e.Login, e.Password)
+			return
+		case "":
+			if fallback == nil {
+				fallback = &c.Netrc[i]
+			}
+		}
+	}
+	if token := c.tokenFor(req.URL.Host + req.URL.Path); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+		return
+	}
+	if fallback != nil {
+		req.SetBasicAuth(fallback.Login, fallback.Password)
+	}
+}
+
+// tokenFor returns the access token with the longest key that is a
+// prefix of hostPath at a path boundary.
+func (c *Credentials) tokenFor(hostPath string) string {
+	var best, token string
+	for prefix, t := range c.AccessTokens {
+		if hostPath != prefix && !strings.HasPrefix(hostPath, strings.TrimSuffix(prefix, "/")+"/") {
+			continue
+		}
+		if len(prefix) > len(best) {
+			best, token = prefix, t
+		}
+	}
+	return token
+}
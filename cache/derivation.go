@@ -0,0 +1,509 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Derivation is a parsed Nix store derivation, the contents of a .drv file.
+type Derivation struct {
+	// Name is the derivation name. The ATerm form does not record it, so
+	// ParseDerivation takes it from the "name" environment variable.
+	Name      string
+	Outputs   map[string]DerivationOutput
+	InputDrvs map[string][]string // .drv path to the output names used
+	InputSrcs []string
+	System    string
+	Builder   string
+	Args      []string
+	Env       map[string]string
+}
+
+// DerivationOutput is one output of a derivation. Path is empty for
+// floating content-addressed outputs; HashAlgo and Hash are set only for
+// fixed-output and content-addressed outputs.
+type DerivationOutput struct {
+	Path string
+	// HashAlgo is the ATerm form of the hashing method and algorithm:
+	// "sha256" for a flat hash, "r:sha256" for a NAR hash and "text:sha256"
+	// for a text hash.
+	HashAlgo string
+	Hash     string // base16
+}
+
+// ReadDerivation reads and parses the .drv file at path.
+func ReadDerivation(path string) (*Derivation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	drv, err := ParseDerivation(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return drv, nil
+}
+
+// ParseDerivation parses a derivation in the ATerm form Nix writes to .drv
+// files: Derive([outputs],[inputDrvs],[inputSrcs],system,builder,[args],[env]).
+func ParseDerivation(data []byte) (*Derivation, error) {
+	p := &atermParser{data: data}
+	drv, err := p.derivation()
+	if err != nil {
+		return nil, fmt.Errorf("invalid derivation at offset %d: %w", p.pos, err)
+	}
+	return drv, nil
+}
+
+type atermParser struct {
+	data []byte
+	pos  int
+}
+
+func (p *atermParser) derivation() (*Derivation, error) {
+	if err := p.expect("Derive(["); err != nil {
+		return nil, err
+	}
+	drv := &Derivation{
+		Outputs:   make(map[string]DerivationOutput),
+		InputDrvs: make(map[string][]string),
+		Env:       make(map[string]string),
+	}
+
+	err := p.list(']', func() error {
+		fields, err := p.tuple(4)
+		if err != nil {
+			return err
+		}
+		if _, dup := drv.Outputs[fields[0]]; dup {
+			return fmt.Errorf("duplicate output %q", fields[0])
+		}
+		drv.Outputs[fields[0]] = DerivationOutput{Path: fields[1], HashAlgo: fields[2], Hash: fields[3]}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect(",["); err != nil {
+		return nil, err
+	}
+	err = p.list(']', func() error {
+		if err := p.expect("("); err != nil {
+			return err
+		}
+		path, err := p.str()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(",["); err != nil {
+			return err
+		}
+		outputs, err := p.strings()
+		if err != nil {
+			return err
+		}
+		if _, dup := drv.InputDrvs[path]; dup {
+			return fmt.Errorf("duplicate input derivation %q", path)
+		}
+		drv.InputDrvs[path] = outputs
+		return p.expect(")")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect(",["); err != nil {
+		return nil, err
+	}
+	if drv.InputSrcs, err = p.strings(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	if drv.System, err = p.str(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(","); err != nil {
+		return nil, err
+	}
+	if drv.Builder, err = p.str(); err != nil {
+		return nil, err
+	}
+	if err := p.expect(",["); err != nil {
+		return nil, err
+	}
+	if drv.Args, err = p.strings(); err != nil {
+		return nil, err
+	}
+
+	if err := p.expect(",["); err != nil {
+		return nil, err
+	}
+	err = p.list(']', func() error {
+		fields, err := p.tuple(2)
+		if err != nil {
+			return err
+		}
+		if _, dup := drv.Env[fields[0]]; dup {
+			return fmt.Errorf("duplicate environment variable %q", fields[0])
+		}
+		drv.Env[fields[0]] = fields[1]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.data) {
+		return nil, fmt.Errorf("trailing data")
+	}
+	drv.Name = drv.Env["name"]
+	return drv, nil
+}
+
+// expect consumes the literal s.
+func (p *atermParser) expect(s string) error {
+	if !bytes.HasPrefix(p.data[p.pos:], []byte(s)) {
+		return fmt.Errorf("expected %q", s)
+	}
+	p.pos += len(s)
+	return nil
+}
+
+// list calls item for each comma-separated element up to and including the
+// closing delimiter. The opening delimiter must already be consumed.
+func (p *atermParser) list(end byte, item func() error) error {
+	for i := 0; ; i++ {
+		if p.pos < len(p.data) && p.data[p.pos] == end {
+			p.pos++
+			return nil
+		}
+		if i > 0 {
+			if err := p.expect(","); err != nil {
+				return err
+			}
+		}
+		if err := item(); err != nil {
+			return err
+		}
+	}
+}
+
+// strings parses the rest of a list of strings.
+func (p *atermParser) strings() ([]string, error) {
+	var ss []string
+	err := p.list(']', func() error {
+		s, err := p.str()
+		ss = append(ss, s)
+		return err
+	})
+	return ss, err
+}
+
+// tuple parses a parenthesized tuple of n strings.
+func (p *atermParser) tuple(n int) ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	fields := make([]string, n)
+	for i := range fields {
+		if i > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		s, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		fields[i] = s
+	}
+	return fields, p.expect(")")
+}
+
+// str parses a quoted string with Nix's escapes.
+func (p *atermParser) str() (string, error) {
+	if err := p.expect(`"`); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.pos == len(p.data) {
+				return "", fmt.Errorf("unterminated string")
+			}
+			c = p.data[p.pos]
+			p.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			}
+		}
+		sb.WriteByte(c)
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+// String returns the ATerm serialization of drv, byte-for-byte what Nix
+// writes for the same derivation: outputs, input derivations, sources and
+// environment are sorted.
+func (drv *Derivation) String() string {
+	var sb strings.Builder
+	sb.WriteString("Derive([")
+	for i, name := range sortedKeys(drv.Outputs) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		out := drv.Outputs[name]
+		writeTuple(&sb, name, out.Path, out.HashAlgo, out.Hash)
+	}
+	sb.WriteString("],[")
+	for i, path := range sortedKeys(drv.InputDrvs) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteByte('(')
+		writeATermString(&sb, path)
+		sb.WriteByte(',')
+		writeATermList(&sb, sortedCopy(drv.InputDrvs[path]))
+		sb.WriteByte(')')
+	}
+	sb.WriteString("],")
+	writeATermList(&sb, sortedCopy(drv.InputSrcs))
+	sb.WriteByte(',')
+	writeATermString(&sb, drv.System)
+	sb.WriteByte(',')
+	writeATermString(&sb, drv.Builder)
+	sb.WriteByte(',')
+	writeATermList(&sb, drv.Args)
+	sb.WriteString(",[")
+	for i, k := range sortedKeys(drv.Env) {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		writeTuple(&sb, k, drv.Env[k])
+	}
+	sb.WriteString("])")
+	return sb.String()
+}
+
+func writeTuple(sb *strings.Builder, fields ...string) {
+	sb.WriteByte('(')
+	for i, f := range fields {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		writeATermString(sb, f)
+	}
+	sb.WriteByte(')')
+}
+
+func writeATermList(sb *strings.Builder, ss []string) {
+	sb.WriteByte('[')
+	for i, s := range ss {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		writeATermString(sb, s)
+	}
+	sb.WriteByte(']')
+}
+
+func writeATermString(sb *strings.Builder, s string) {
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedCopy(ss []string) []string {
+	ss = append([]string(nil), ss...)
+	sort.Strings(ss)
+	return ss
+}
+
+// derivationJSON is the per-derivation object printed by
+// `nix derivation show`. Older Nix versions map each input derivation to a
+// list of outputs, newer ones to an object; recent versions also print
+// store paths as base names and split the output hash method into its own
+// field.
+type derivationJSON struct {
+	Name    string `json:"name"`
+	Outputs map[string]struct {
+		Path     string `json:"path,omitempty"`
+		Method   string `json:"method,omitempty"`
+		HashAlgo string `json:"hashAlgo,omitempty"`
+		Hash     string `json:"hash,omitempty"`
+	} `json:"outputs"`
+	InputDrvs map[string]json.RawMessage `json:"inputDrvs"`
+	InputSrcs []string                   `json:"inputSrcs"`
+	System    string                     `json:"system"`
+	Builder   string                     `json:"builder"`
+	Args      []string                   `json:"args"`
+	Env       map[string]string          `json:"env"`
+}
+
+// ParseDerivationsJSON parses the output of `nix derivation show`, a map
+// from .drv path to derivation.
+func ParseDerivationsJSON(data []byte) (map[string]*Derivation, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid derivation JSON: %w", err)
+	}
+	drvs := make(map[string]*Derivation, len(raw))
+	for path, msg := range raw {
+		drv := new(Derivation)
+		if err := drv.UnmarshalJSON(msg); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		drvs[fullStorePath(path)] = drv
+	}
+	return drvs, nil
+}
+
+// UnmarshalJSON parses a single derivation object in the form printed by
+// `nix derivation show`.
+func (drv *Derivation) UnmarshalJSON(data []byte) error {
+	var j derivationJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return fmt.Errorf("invalid derivation JSON: %w", err)
+	}
+	*drv = Derivation{
+		Name:      j.Name,
+		Outputs:   make(map[string]DerivationOutput, len(j.Outputs)),
+		InputDrvs: make(map[string][]string, len(j.InputDrvs)),
+		System:    j.System,
+		Builder:   j.Builder,
+		Args:      j.Args,
+		Env:       j.Env,
+	}
+	if drv.Env == nil {
+		drv.Env = make(map[string]string)
+	}
+	for name, o := range j.Outputs {
+		out := DerivationOutput{HashAlgo: o.HashAlgo, Hash: o.Hash}
+		if o.Path != "" {
+			out.Path = fullStorePath(o.Path)
+		}
+		switch o.Method {
+		case "", "flat":
+		case "nar":
+			out.HashAlgo = "r:" + o.HashAlgo
+		case "text":
+			out.HashAlgo = "text:" + o.HashAlgo
+		default:
+			return fmt.Errorf("output %s: unsupported hash method %q", name, o.Method)
+		}
+		drv.Outputs[name] = out
+	}
+	for path, msg := range j.InputDrvs {
+		var outputs []string
+		if err := json.Unmarshal(msg, &outputs); err != nil {
+			var obj struct {
+				Outputs []string `json:"outputs"`
+			}
+			if err := json.Unmarshal(msg, &obj); err != nil {
+				return fmt.Errorf("input derivation %s: %w", path, err)
+			}
+			outputs = obj.Outputs
+		}
+		drv.InputDrvs[fullStorePath(path)] = outputs
+	}
+	for _, src := range j.InputSrcs {
+		drv.InputSrcs = append(drv.InputSrcs, fullStorePath(src))
+	}
+	return nil
+}
+
+// MarshalJSON returns drv in the form printed by `nix derivation show` for
+// a single derivation.
+func (drv *Derivation) MarshalJSON() ([]byte, error) {
+	type outputJSON struct {
+		Path     string `json:"path,omitempty"`
+		HashAlgo string `json:"hashAlgo,omitempty"`
+		Hash     string `json:"hash,omitempty"`
+	}
+	type inputJSON struct {
+		DynamicOutputs struct{} `json:"dynamicOutputs"`
+		Outputs        []string `json:"outputs"`
+	}
+	j := struct {
+		Name      string                `json:"name"`
+		Outputs   map[string]outputJSON `json:"outputs"`
+		InputDrvs map[string]inputJSON  `json:"inputDrvs"`
+		InputSrcs []string              `json:"inputSrcs"`
+		System    string                `json:"system"`
+		Builder   string                `json:"builder"`
+		Args      []string              `json:"args"`
+		Env       map[string]string     `json:"env"`
+	}{
+		Name:      drv.Name,
+		Outputs:   make(map[string]outputJSON, len(drv.Outputs)),
+		InputDrvs: make(map[string]inputJSON, len(drv.InputDrvs)),
+		InputSrcs: sortedCopy(drv.InputSrcs),
+		System:    drv.System,
+		Builder:   drv.Builder,
+		Args:      drv.Args,
+		Env:       drv.Env,
+	}
+	for name, out := range drv.Outputs {
+		j.Outputs[name] = outputJSON(out)
+	}
+	for path, outputs := range drv.InputDrvs {
+		j.InputDrvs[path] = inputJSON{Outputs: sortedCopy(outputs)}
+	}
+	if j.Args == nil {
+		j.Args = []string{}
+	}
+	if j.InputSrcs == nil {
+		j.InputSrcs = []string{}
+	}
+	return json.Marshal(j)
+}
+
+// fullStorePath prefixes base names with the store directory.
+func fullStorePath(path string) string {
+	if strings.HasPrefix(path, "/") {
+		return path
+	}
+	return DefaultStoreDir + "/" + path
+}
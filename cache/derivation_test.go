@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testDrv = `Derive([("out","/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2","","")],` +
+	`[("/nix/store/0mxlhrmr16mkll2k9xqdp4cm4l8fbghx-stdenv-linux.drv",["out"]),` +
+	`("/nix/store/y8rb1sbk7yz3x0hm2r7d3z0r4ydy1sz8-hello-2.12.2.tar.gz.drv",["out"])],` +
+	`["/nix/store/shkw4qm9qcw5sc5n1k5jznc83ny02r39-default-builder.sh"],"x86_64-linux",` +
+	`"/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-bash-5.2p37/bin/bash",` +
+	`["-e","/nix/store/shkw4qm9qcw5sc5n1k5jznc83ny02r39-default-builder.sh"],` +
+	`[("builder","/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-bash-5.2p37/bin/bash"),` +
+	`("name","hello-2.12.2"),("out","/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2"),` +
+	`("pname","hello"),("script","echo \"quoted\" \\ back\n\tdone"),("system","x86_64-linux")])`
+
+func TestParseDerivation(t *testing.T) {
+	drv, err := ParseDerivation([]byte(testDrv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drv.Name != "hello-2.12.2" || drv.System != "x86_64-linux" {
+		t.Errorf("Name, System = %q, %q", drv.Name, drv.System)
+	}
+	if got := drv.Outputs["out"].Path; got != "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2" {
+		t.Errorf("out path = %q", got)
+	}
+	if len(drv.InputDrvs) != 2 || len(drv.InputSrcs) != 1 || len(drv.Args) != 2 {
+		t.Errorf("inputDrvs, inputSrcs, args = %v, %v, %v", drv.InputDrvs, drv.InputSrcs, drv.Args)
+	}
+	if got, want := drv.Env["script"], "echo \"quoted\" \\ back\n\tdone"; got != want {
+		t.Errorf("script = %q; want %q", got, want)
+	}
+	if got := drv.String(); got != testDrv {
+		t.Errorf("String() did not round-trip:\n got %s\nwant %s", got, testDrv)
+	}
+}
+
+func TestParseDerivationErrors(t *testing.T) {
+	for _, bad := range []string{
+		"",
+		testDrv[:len(testDrv)-1],
+		testDrv + "\n",
+		`Derive([("out","/nix/store/x","",""),("out","/nix/store/y","","")],[],[],"s","b",[],[])`,
+		`Derive([],[],[],"s","b",[],[("a","1"),("a","2")])`,
+		`Derive([],[],[],"s","b",["unterminated],[])`,
+	} {
+		if _, err := ParseDerivation([]byte(bad)); err == nil {
+			t.Errorf("ParseDerivation(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParseDerivationsJSON(t *testing.T) {
+	want, err := ParseDerivation([]byte(testDrv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(map[string]*Derivation{"/nix/store/ad2pn3plqvrb8dydl9ri3ahbc4lxfss2-hello-2.12.2.drv": want})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drvs, err := ParseDerivationsJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := drvs["/nix/store/ad2pn3plqvrb8dydl9ri3ahbc4lxfss2-hello-2.12.2.drv"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("JSON round trip = %+v; want %+v", got, want)
+	}
+
+	// Older Nix lists input outputs directly; newer Nix prints base names
+	// and a separate hash method.
+	drvs, err = ParseDerivationsJSON([]byte(`{
+		"ad2pn3plqvrb8dydl9ri3ahbc4lxfss2-src.drv": {
+			"name": "src",
+			"outputs": {"out": {"path": "y8rb1sbk7yz3x0hm2r7d3z0r4ydy1sz8-src", "method": "nar", "hashAlgo": "sha256", "hash": "00"}},
+			"inputDrvs": {"/nix/store/0mxlhrmr16mkll2k9xqdp4cm4l8fbghx-stdenv-linux.drv": ["out"]},
+			"inputSrcs": [], "system": "builtin", "builder": "builtin:fetchurl", "args": [], "env": {}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drv := drvs["/nix/store/ad2pn3plqvrb8dydl9ri3ahbc4lxfss2-src.drv"]
+	if drv == nil {
+		t.Fatalf("derivation not found in %v", drvs)
+	}
+	wantOut := DerivationOutput{Path: "/nix/store/y8rb1sbk7yz3x0hm2r7d3z0r4ydy1sz8-src", HashAlgo: "r:sha256", Hash: "00"}
+	if drv.Outputs["out"] != wantOut {
+		t.Errorf("out = %+v; want %+v", drv.Outputs["out"], wantOut)
+	}
+	if got := drv.InputDrvs["/nix/store/0mxlhrmr16mkll2k9xqdp4cm4l8fbghx-stdenv-linux.drv"]; !reflect.DeepEqual(got, []string{"out"}) {
+		t.Errorf("input outputs = %v", got)
+	}
+}
@@ -0,0 +1,144 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// DefaultNegativeTTL is how long a "not in cache" answer is remembered,
+// matching Nix's narinfo-cache-negative-ttl default.
+const DefaultNegativeTTL = time.Hour
+
+// NarInfoDiskCache persists narinfo lookups across Gazelle runs, like Nix's
+// narinfo disk cache. Positive entries never expire because a store path's
+// narinfo never changes; negative entries expire after NegativeTTL.
+//
+// Entries are written to a temporary file and renamed into place, so
+// concurrent processes sharing a directory see either a complete entry or
+// none.
+type NarInfoDiskCache struct {
+	Dir         string
+	NegativeTTL time.Duration
+}
+
+// DefaultNarInfoCacheDir returns the per-user directory used for the
+// narinfo disk cache.
+func DefaultNarInfoCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "nix-bazel-via-bwrap", "narinfo"), nil
+}
+
+// NewNarInfoDiskCache returns a disk cache rooted at dir.
+func NewNarInfoDiskCache(dir string) *NarInfoDiskCache {
+	return &NarInfoDiskCache{Dir: dir, NegativeTTL: DefaultNegativeTTL}
+}
+
+// entryPath returns the file for a substituter and store hash. Substituter
+// URLs are hashed so any URL maps to a safe directory name.
+func (d *NarInfoDiskCache) entryPath(cacheURL, storeHash, suffix string) string {
+	sum := sha256.Sum256([]byte(cacheURL))
+	return filepath.Join(d.Dir, hex.EncodeToString(sum[:8]), storeHash+suffix)
+}
+
+// Get returns the cached narinfo text for storeHash at cacheURL. found
+// reports whether the disk cache has an answer at all; a found entry with
+// empty content is a cached "not in cache" result.
+func (d *NarInfoDiskCache) Get(cacheURL, storeHash string) (content string, found bool) {
+	// An empty entry is one a crash cut short; see write.
+	if data, err := os.ReadFile(d.entryPath(cacheURL, storeHash, ".narinfo")); err == nil && len(data) > 0 {
+		return string(data), true
+	}
+	info, err := os.Stat(d.entryPath(cacheURL, storeHash, ".missing"))
+	if err == nil && time.Since(info.ModTime()) < d.NegativeTTL {
+		return "", true
+	}
+	return "", false
+}
+
+// PutPositive records the narinfo text served for storeHash.
+func (d *NarInfoDiskCache) PutPositive(cacheURL, storeHash, content string) error {
+	return d.write(d.entryPath(cacheURL, storeHash, ".narinfo"), []byte(content))
+}
+
+// PutNegative records that cacheURL does not have storeHash.
+func (d *NarInfoDiskCache) PutNegative(cacheURL, storeHash string) error {
+	return d.write(d.entryPath(cacheURL, storeHash, ".missing"), nil)
+}
+
+// write stores an entry without syncing it: losing an entry to a crash
+// only costs a lookup, which is cheaper than two fsyncs per narinfo.
+func (d *NarInfoDiskCache) write(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return renameFileAtomic(path, data, false)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never observe a partial file. The file is
+// synced before the rename and its directory after, so that a crash leaves
+// either the old or the new contents rather than an empty file.
+func writeFileAtomic(path string, data []byte) error {
+	return renameFileAtomic(path, data, true)
+}
+
+// renameFileAtomic is writeFileAtomic, with the syncs only if durable.
+func renameFileAtomic(path string, data []byte, durable bool) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	// CreateTemp uses 0600; entries may be shared with other users.
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if durable {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if !durable {
+		return nil
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the entries of dir durable. Filesystems that cannot sync
+// directories are not an error.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// ErrNotFound reports that no substituter has the requested file.
+var ErrNotFound = errors.New("not found in binary cache")
+
+// HashMismatchError reports that data did not match the hash or size
+// recorded for it.
+type HashMismatchError struct {
+	What     string // e.g. "NAR hash", "NAR size" or "store path hash"
+	Expected string
+	Actual   string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("%s mismatch: expected %s, got %s", e.What, e.Expected, e.Actual)
+}
+
+// TransientError reports a failure that may succeed if tried again later,
+// such as a 5xx response or a reset connection, that persisted through
+// every retry.
+type TransientError struct {
+	URL string
+	Err error
+}
+
+func (e *TransientError) Error() string {
+	return fmt.Sprintf("transient failure fetching %s: %v", e.URL, e.Err)
+}
+
+func (e *TransientError) Unwrap() error { return e.Err }
+
+// IsTransient reports whether err is, or wraps, a *TransientError.
+func IsTransient(err error) bool {
+	var te *TransientError
+	return errors.As(err, &te)
+}
+
+// StatusError reports an unexpected HTTP status from a substituter.
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d for %s", e.StatusCode, e.URL)
+}
+
+// checkStatus maps a response status to ErrNotFound, a *StatusError, or
+// nil for 200.
+func checkStatus(resp *http.Response, url string) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		return fmt.Errorf("%s: %w", url, ErrNotFound)
+	default:
+		return &StatusError{URL: url, StatusCode: resp.StatusCode}
+	}
+}
+
+// retryable reports whether a failed attempt is worth repeating. Nothing is
+// retried once ctx itself is done.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 || se.StatusCode == http.StatusTooManyRequests
+	}
+	// An attempt's own deadline expired while ctx is still live.
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTemporary || dnsErr.IsTimeout
+	}
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// HashAlgorithms lists the algorithms Hash supports, by their Nix names.
+var HashAlgorithms = []string{"sha1", "sha256", "sha512"}
+
+// Hash is a digest with its algorithm, convertible between every encoding
+// Nix uses: base16, Nix base32, base64 and SRI.
+type Hash struct {
+	Algorithm string // "sha1", "sha256" or "sha512"
+	Digest    []byte
+}
+
+// HashSize returns the digest size in bytes of a Nix hash algorithm, or 0
+// if it is not supported.
+func HashSize(algorithm string) int {
+	switch algorithm {
+	case "sha1":
+		return sha1.Size
+	case "sha256":
+		return sha256.Size
+	case "sha512":
+		return sha512.Size
+	default:
+		return 0
+	}
+}
+
+// NewHasher returns a hash.Hash computing algorithm.
+func NewHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", algorithm)
+	}
+}
+
+// ParseHash parses a hash in any form Nix prints one: SRI
+// ("sha256-<base64>") or "<algo>:<digest>" with the digest in base16, Nix
+// base32 or base64.
+func ParseHash(s string) (Hash, error) {
+	return ParseHashWithAlgorithm(s, "")
+}
+
+// ParseHashWithAlgorithm is like ParseHash but also accepts a bare digest
+// of the given algorithm, as in a derivation's outputHash with
+// outputHashAlgo. If algorithm is set, a prefixed hash must match it.
+func ParseHashWithAlgorithm(s, algorithm string) (Hash, error) {
+	algo, digest := algorithm, s
+	if a, d, ok := strings.Cut(s, ":"); ok {
+		algo, digest = a, d
+	} else if a, d, ok := strings.Cut(s, "-"); ok && HashSize(a) != 0 {
+		// SRI digests are always base64.
+		h, err := decodeHashDigest(a, d, base64Encoding)
+		if err != nil {
+			return Hash{}, fmt.Errorf("invalid SRI hash %q: %w", s, err)
+		}
+		algo = a
+		if algorithm != "" && algo != algorithm {
+			return Hash{}, fmt.Errorf("hash %q is %s, expected %s", s, algo, algorithm)
+		}
+		return h, nil
+	}
+	if algo == "" {
+		return Hash{}, fmt.Errorf("hash %q does not specify an algorithm", s)
+	}
+	if algorithm != "" && algo != algorithm {
+		return Hash{}, fmt.Errorf("hash %q is %s, expected %s", s, algo, algorithm)
+	}
+	h, err := decodeHashDigest(algo, digest, anyEncoding)
+	if err != nil {
+		return Hash{}, fmt.Errorf("invalid hash %q: %w", s, err)
+	}
+	return h, nil
+}
+
+type hashEncoding int
+
+const (
+	anyEncoding hashEncoding = iota
+	base64Encoding
+)
+
+// decodeHashDigest decodes a digest, telling the encodings apart by length
+// as Nix does.
+func decodeHashDigest(algo, digest string, enc hashEncoding) (Hash, error) {
+	size := HashSize(algo)
+	if size == 0 {
+		return Hash{}, fmt.Errorf("unsupported hash algorithm %q", algo)
+	}
+	var raw []byte
+	var err error
+	switch {
+	case enc == anyEncoding && len(digest) == hex.EncodedLen(size):
+		raw, err = hex.DecodeString(digest)
+	case enc == anyEncoding && len(digest) == nixBase32Len(size):
+		raw, err = DecodeNixBase32(digest, size)
+	case len(digest) == base64.StdEncoding.EncodedLen(size):
+		raw, err = base64.StdEncoding.DecodeString(digest)
+	default:
+		return Hash{}, fmt.Errorf("wrong length %d for a %s digest", len(digest), algo)
+	}
+	if err != nil {
+		return Hash{}, err
+	}
+	return Hash{Algorithm: algo, Digest: raw}, nil
+}
+
+// String returns the hash as "<algo>:<base32>", the form used in narinfo
+// files.
+func (h Hash) String() string {
+	return h.Algorithm + ":" + h.Base32()
+}
+
+// Base16 returns the digest in lowercase hex.
+func (h Hash) Base16() string { return hex.EncodeToString(h.Digest) }
+
+// Base32 returns the digest in Nix base32.
+func (h Hash) Base32() string { return EncodeNixBase32(h.Digest) }
+
+// Base64 returns the digest in standard base64.
+func (h Hash) Base64() string { return base64.StdEncoding.EncodeToString(h.Digest) }
+
+// SRI returns the hash in Subresource Integrity form, as Bazel's integrity
+// attributes expect.
+func (h Hash) SRI() string { return h.Algorithm + "-" + h.Base64() }
+
+// Equal reports whether h and o are the same digest of the same algorithm.
+func (h Hash) Equal(o Hash) bool {
+	return h.Algorithm == o.Algorithm && string(h.Digest) == string(o.Digest)
+}
+
+// nixBase32Alphabet is the digit set of Nix's base32 encoding, which omits
+// e, o, u and t.
+const nixBase32Alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
+
+// nixBase32Len returns the length of the Nix base32 encoding of size bytes.
+func nixBase32Len(size int) int {
+	return (size*8-1)/5 + 1
+}
+
+// EncodeNixBase32 encodes a digest in Nix's base32 form, as used in store
+// paths and NarHash/FileHash fields.
+func EncodeNixBase32(hash []byte) string {
+	if len(hash) == 0 {
+		return ""
+	}
+	length := nixBase32Len(len(hash))
+	out := make([]byte, length)
+	for n := length - 1; n >= 0; n-- {
+		b := n * 5
+		i := b / 8
+		j := b % 8
+		c := hash[i] >> j
+		if i+1 < len(hash) {
+			c |= hash[i+1] << (8 - j)
+		}
+		out[length-1-n] = nixBase32Alphabet[c&0x1f]
+	}
+	return string(out)
+}
+
+// DecodeNixBase32 decodes a Nix base32 string into a digest of size bytes.
+func DecodeNixBase32(s string, size int) ([]byte, error) {
+	if len(s) != nixBase32Len(size) {
+		return nil, fmt.Errorf("wrong length %d for %d bytes of Nix base32", len(s), size)
+	}
+	out := make([]byte, size)
+	for n := 0; n < len(s); n++ {
+		c := s[len(s)-n-1]
+		digit := strings.IndexByte(nixBase32Alphabet, c)
+		if digit < 0 {
+			return nil, fmt.Errorf("invalid Nix base32 character %q", c)
+		}
+		b := n * 5
+		i := b / 8
+		j := b % 8
+		out[i] |= byte(digit << j)
+		carry := byte(digit >> (8 - j))
+		if i+1 < size {
+			out[i+1] |= carry
+		} else if carry != 0 {
+			return nil, fmt.Errorf("invalid Nix base32 string %q: excess bits", s)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseHashRoundTrip(t *testing.T) {
+	for _, algo := range HashAlgorithms {
+		hasher, err := NewHasher(algo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hasher.Write([]byte("hello"))
+		want := Hash{Algorithm: algo, Digest: hasher.Sum(nil)}
+
+		forms := []string{
+			want.String(),
+			want.SRI(),
+			algo + ":" + want.Base16(),
+			algo + ":" + want.Base64(),
+		}
+		for _, s := range forms {
+			got, err := ParseHash(s)
+			if err != nil || !got.Equal(want) {
+				t.Errorf("ParseHash(%q) = %v, %v; want %v", s, got, err, want)
+			}
+		}
+		for _, bare := range []string{want.Base16(), want.Base32(), want.Base64()} {
+			got, err := ParseHashWithAlgorithm(bare, algo)
+			if err != nil || !got.Equal(want) {
+				t.Errorf("ParseHashWithAlgorithm(%q, %s) = %v, %v; want %v", bare, algo, got, err, want)
+			}
+		}
+	}
+}
+
+func TestParseHashKnownValues(t *testing.T) {
+	// sha256("") in each encoding Nix prints.
+	want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	for _, s := range []string{
+		"sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		"sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"sha256:" + want,
+	} {
+		h, err := ParseHash(s)
+		if err != nil || h.Base16() != want {
+			t.Errorf("ParseHash(%q) = %s, %v; want %s", s, h.Base16(), err, want)
+		}
+	}
+}
+
+func TestParseHashErrors(t *testing.T) {
+	for _, s := range []string{
+		"0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",        // no algorithm
+		"md5:d41d8cd98f00b204e9800998ecf8427e",                        // unsupported algorithm
+		"sha256:abc",                                                  // wrong length
+		"sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c7e", // 'e' is not base32
+		"sha256:" + strings.Repeat("z", 52),                           // excess bits
+		"sha1-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",           // wrong length for sha1
+	} {
+		if h, err := ParseHash(s); err == nil {
+			t.Errorf("ParseHash(%q) = %v; want an error", s, h)
+		}
+	}
+	if _, err := ParseHashWithAlgorithm("sha256-47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", "sha512"); err == nil {
+		t.Error("ParseHashWithAlgorithm accepted a hash of the wrong algorithm")
+	}
+}
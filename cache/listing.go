@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NarListing is the JSON listing of a NAR's contents that binary caches
+// serve as <hash>.ls next to the narinfo.
+type NarListing struct {
+	Version int           `json:"version"`
+	Root    *ListingEntry `json:"root"`
+}
+
+// ListingEntry is one node of a NarListing.
+type ListingEntry struct {
+	Type       string                   `json:"type"` // "regular", "directory" or "symlink"
+	Size       int64                    `json:"size,omitempty"`
+	Executable bool                     `json:"executable,omitempty"`
+	NarOffset  int64                    `json:"narOffset,omitempty"`
+	Target     string                   `json:"target,omitempty"`
+	Entries    map[string]*ListingEntry `json:"entries,omitempty"`
+}
+
+// ParseNarListing parses a .ls file.
+func ParseNarListing(data []byte) (*NarListing, error) {
+	var l NarListing
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, fmt.Errorf("invalid NAR listing: %w", err)
+	}
+	if l.Version != 1 {
+		return nil, fmt.Errorf("unsupported NAR listing version %d", l.Version)
+	}
+	if l.Root == nil {
+		return nil, fmt.Errorf("invalid NAR listing: missing root")
+	}
+	return &l, nil
+}
+
+// Lookup returns the entry at a slash-separated path relative to the root,
+// or nil if there is none. Symlinks are not followed.
+func (l *NarListing) Lookup(path string) *ListingEntry {
+	e := l.Root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if e == nil || e.Type != "directory" {
+			return nil
+		}
+		e = e.Entries[name]
+	}
+	return e
+}
+
+// Executables returns the sorted names of the programs in dir: executable
+// regular files and symlinks, which in bin/ nearly always point at one.
+func (l *NarListing) Executables(dir string) []string {
+	d := l.Lookup(dir)
+	if d == nil || d.Type != "directory" {
+		return nil
+	}
+	var names []string
+	for name, e := range d.Entries {
+		if e.Type == "symlink" || (e.Type == "regular" && e.Executable) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ListPath builds the listing of the file tree at path, as Nix writes it
+// when adding the path to a binary cache. NAR offsets are omitted. Like
+// WriteNar, it lists the symlinks in path's symlink manifest in place and
+// leaves out the manifest.
+func ListPath(path string) (*NarListing, error) {
+	tree, err := newSymlinkTree(path)
+	if err != nil {
+		return nil, err
+	}
+	root, err := listEntry(tree, path)
+	if err != nil {
+		return nil, err
+	}
+	return &NarListing{Version: 1, Root: root}, nil
+}
+
+func listEntry(tree symlinkTree, path string) (*ListingEntry, error) {
+	if target, ok := tree.symlink(path); ok {
+		return &ListingEntry{Type: "symlink", Target: target}, nil
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		return nil, err
+	}
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		return &ListingEntry{Type: "regular", Size: info.Size(), Executable: mode&0100 != 0}, nil
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		return &ListingEntry{Type: "symlink", Target: target}, nil
+	case mode.IsDir():
+		names, err := tree.readDir(path)
+		if err != nil {
+			return nil, err
+		}
+		dir := &ListingEntry{Type: "directory", Entries: make(map[string]*ListingEntry, len(names))}
+		for _, name := range names {
+			child, err := listEntry(tree, filepath.Join(path, name))
+			if err != nil {
+				return nil, err
+			}
+			dir.Entries[name] = child
+		}
+		return dir, nil
+	default:
+		return nil, fmt.Errorf("cannot list %s: unsupported file type %s", path, mode.Type())
+	}
+}
+
+// NarListing fetches the listing of the NAR described by info from the
+// cache that served it. Returns nil, nil if the cache has no listing.
+func (c *Cache) NarListing(info *NarInfo) (*NarListing, error) {
+	return c.NarListingContext(context.Background(), info)
+}
+
+// NarListingContext is like NarListing but gives up when ctx is done.
+func (c *Cache) NarListingContext(ctx context.Context, info *NarInfo) (*NarListing, error) {
+	cacheURL := info.CacheURL
+	if cacheURL == "" {
+		cacheURL = c.URL
+	}
+	body, err := c.fetch(ctx, fmt.Sprintf("%s/%s.ls", cacheURL, StoreHash(info.StorePath)))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseNarListing(body)
+}
@@ -0,0 +1,239 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LocalStore is a directory of unpacked NARs shared by every workspace and
+// output base on a machine, so each NAR is unpacked once rather than once
+// per tree artifact. Entries are keyed by NarHash, which is verified while
+// unpacking, and never change once in place:
+//
+//	<dir>/nars/<algo>-<hex>  the tree a NAR unpacks to, as UnpackNar lays it
+//	                         out in an existing directory
+//	<dir>/links/<base32>     one hard link per distinct file, kept by Optimise
+//	<dir>/tmp/               unpacks and links in progress
+//
+// Link exposes an entry to Bazel with reflinks where the filesystem supports
+// them and plain copies otherwise. It never hard links: Bazel changes the
+// permissions of its outputs, which would change the store's files too.
+// Hard links are only used between entries, by Optimise.
+type LocalStore struct {
+	Dir string
+}
+
+// DefaultLocalStoreDir returns the per-user directory used for the local
+// store.
+func DefaultLocalStoreDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "nix-bazel-via-bwrap", "store"), nil
+}
+
+// NewLocalStore returns a local store rooted at dir.
+func NewLocalStore(dir string) *LocalStore {
+	return &LocalStore{Dir: dir}
+}
+
+// entryPath returns the entry of the NAR with hash h.
+func (s *LocalStore) entryPath(h Hash) string {
+	return filepath.Join(s.Dir, "nars", h.Algorithm+"-"+h.Base16())
+}
+
+// Unpack returns the entry for the NAR opts.NarHash, unpacking it from r
+// first if the store does not have it yet. opts.NarHash is required, since
+// it is the key; r is not read when the entry already exists.
+//
+// Concurrent unpacks of the same NAR are safe: each unpacks into its own
+// temporary directory and the first to finish renames it into place.
+func (s *LocalStore) Unpack(r io.Reader, compression string, opts UnpackOptions) (string, error) {
+	if opts.NarHash == "" {
+		return "", fmt.Errorf("the local store needs the NAR hash to unpack into")
+	}
+	h, err := ParseHash(opts.NarHash)
+	if err != nil {
+		return "", fmt.Errorf("invalid expected NAR hash: %w", err)
+	}
+	entry := s.entryPath(h)
+	if _, err := os.Stat(entry); err == nil {
+		return entry, nil
+	}
+
+	tmpDir := filepath.Join(s.Dir, "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(entry), 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(tmpDir, filepath.Base(entry)+"-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+	// MkdirTemp uses 0700; the store may be shared with other users.
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return "", err
+	}
+	if err := UnpackNarWithOptions(r, compression, tmp, opts); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, entry); err != nil {
+		// Another process may have unpacked the same NAR first.
+		if _, statErr := os.Stat(entry); statErr == nil {
+			return entry, nil
+		}
+		return "", err
+	}
+	return entry, nil
+}
+
+// Link recreates the tree at entry under dest, which may already exist as
+// an empty directory. Regular files are reflinked or copied; see linkFile.
+func (s *LocalStore) Link(entry, dest string) error {
+	return filepath.WalkDir(entry, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(entry, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return linkFile(p, target)
+		default:
+			return fmt.Errorf("%s: unsupported file type %s", p, d.Type())
+		}
+	})
+}
+
+// linkFile makes dst an independent copy of src as cheaply as the
+// filesystem allows: a reflink, which shares data but not metadata, or else
+// a plain copy.
+func linkFile(src, dst string) error {
+	if err := reflink(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// OptimiseReport summarizes what LocalStore.Optimise deduplicated.
+type OptimiseReport struct {
+	// Files is the number of files replaced by a hard link to an identical
+	// one, and BytesSaved the space that freed.
+	Files      int
+	BytesSaved int64
+}
+
+// Optimise replaces identical files across the store's entries with hard
+// links to a single copy, like `nix-store --optimise`. Files are identical
+// when their NAR serializations are, so the executable bit must match too.
+// Each distinct file is kept under links/, named after its NAR hash.
+func (s *LocalStore) Optimise() (OptimiseReport, error) {
+	var report OptimiseReport
+	linksDir := filepath.Join(s.Dir, "links")
+	tmpDir := filepath.Join(s.Dir, "tmp")
+	for _, dir := range []string{linksDir, tmpDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return report, err
+		}
+	}
+	// Each run links into its own directory, so concurrent runs never
+	// reuse each other's temporary names.
+	runDir, err := os.MkdirTemp(tmpDir, "optimise-*")
+	if err != nil {
+		return report, err
+	}
+	defer os.RemoveAll(runDir)
+
+	err = filepath.WalkDir(filepath.Join(s.Dir, "nars"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		// As in Nix, empty files are not worth a link.
+		if info.Size() == 0 {
+			return nil
+		}
+		h, _, err := HashPathWithAlgorithm(p, "sha256")
+		if err != nil {
+			return err
+		}
+		link := filepath.Join(linksDir, h.Base32())
+
+		linkInfo, err := os.Lstat(link)
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := os.Link(p, link); err == nil || !errors.Is(err, fs.ErrExist) {
+				return err
+			}
+			// Another process linked an identical file first.
+			linkInfo, err = os.Lstat(link)
+		}
+		if err != nil {
+			return err
+		}
+		if os.SameFile(info, linkInfo) {
+			return nil
+		}
+
+		// Replace p atomically, so readers never see it missing.
+		tmp := filepath.Join(runDir, h.Base32())
+		if err := os.Link(link, tmp); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, p); err != nil {
+			if rmErr := os.Remove(tmp); rmErr != nil {
+				return errors.Join(err, rmErr)
+			}
+			return err
+		}
+		report.Files++
+		report.BytesSaved += info.Size()
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return report, err
+}
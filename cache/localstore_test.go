@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLocalStore(t *testing.T) {
+	pack := func(files map[string]string) ([]byte, string) {
+		src := t.TempDir()
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		nar, err := io.ReadAll(PackNar(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, _, err := HashPath(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nar, hash
+	}
+	shared := string(bytes.Repeat([]byte("libc"), 1024))
+	narA, hashA := pack(map[string]string{"libc.so": shared, "a": "a"})
+	narB, hashB := pack(map[string]string{"libc.so": shared, "b": "b"})
+
+	s := NewLocalStore(t.TempDir())
+	if _, err := s.Unpack(bytes.NewReader(narA), "none", UnpackOptions{}); err == nil {
+		t.Error("Unpack without a NAR hash succeeded")
+	}
+
+	entryA, err := s.Unpack(bytes.NewReader(narA), "none", UnpackOptions{NarHash: hashA})
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	// The second unpack must not read the NAR again.
+	again, err := s.Unpack(bytes.NewReader(nil), "none", UnpackOptions{NarHash: hashA})
+	if err != nil || again != entryA {
+		t.Errorf("Unpack of a stored NAR = %q, %v; want %q", again, err, entryA)
+	}
+	for _, dest := range []string{filepath.Join(t.TempDir(), "one"), filepath.Join(t.TempDir(), "two")} {
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Link(entryA, dest); err != nil {
+			t.Fatalf("Link: %v", err)
+		}
+		linked, _, err := HashPath(dest)
+		if err != nil || linked != hashA {
+			t.Errorf("linked tree hashes to %q, %v; want %q", linked, err, hashA)
+		}
+	}
+
+	entryB, err := s.Unpack(bytes.NewReader(narB), "none", UnpackOptions{NarHash: hashB})
+	if err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+	report, err := s.Optimise()
+	if err != nil {
+		t.Fatalf("Optimise: %v", err)
+	}
+	if report.Files != 1 || report.BytesSaved != int64(len(shared)) {
+		t.Errorf("Optimise = %+v; want 1 file, %d bytes", report, len(shared))
+	}
+	infoA, errA := os.Stat(filepath.Join(entryA, "libc.so"))
+	infoB, errB := os.Stat(filepath.Join(entryB, "libc.so"))
+	if errA != nil || errB != nil || !os.SameFile(infoA, infoB) {
+		t.Errorf("identical files were not linked: %v, %v", errA, errB)
+	}
+	if report, err := s.Optimise(); err != nil || report.Files != 0 {
+		t.Errorf("second Optimise = %+v, %v; want nothing to do", report, err)
+	}
+
+	// Bazel makes its outputs read-only and executable; that must not
+	// reach the store, even for files Optimise shares between entries.
+	out := t.TempDir()
+	if err := s.Link(entryA, out); err != nil {
+		t.Fatalf("Link: %v", err)
+	}
+	err = filepath.WalkDir(out, func(p string, d os.DirEntry, err error) error {
+		if err != nil || p == out {
+			return err
+		}
+		return os.Chmod(p, 0555)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for entry, want := range map[string]string{entryA: hashA, entryB: hashB} {
+		if got, _, err := HashPath(entry); err != nil || got != want {
+			t.Errorf("%s hashes to %q, %v after chmod of a linked output; want %q", entry, got, err, want)
+		}
+	}
+}
+
+func TestOptimiseConcurrently(t *testing.T) {
+	s := NewLocalStore(t.TempDir())
+	shared := bytes.Repeat([]byte("libc"), 1024)
+	var entries []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		src := t.TempDir()
+		if err := os.WriteFile(filepath.Join(src, "libc.so"), shared, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(src, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		hash, _, err := HashPath(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := PackNar(src)
+		entry, err := s.Unpack(r, "none", UnpackOptions{NarHash: hash})
+		r.Close()
+		if err != nil {
+			t.Fatalf("Unpack: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := s.Optimise(); err != nil {
+				t.Errorf("Optimise: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	first, err := os.Stat(filepath.Join(entries[0], "libc.so"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries[1:] {
+		if info, err := os.Stat(filepath.Join(entry, "libc.so")); err != nil || !os.SameFile(first, info) {
+			t.Errorf("%s/libc.so was not linked: %v", entry, err)
+		}
+	}
+}
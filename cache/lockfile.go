@@ -2,36 +2,81 @@ package cache
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 // LockFile represents the nix.lock file format.
 type LockFile struct {
 	Version       int                    `json:"version"`
+	Layout        string                 `json:"layout,omitempty"` // "" or LockFileLayoutSharded
 	NixpkgsCommit string                 `json:"nixpkgs_commit,omitempty"`
-	Flakes        map[string]FlakeInfo   `json:"flakes"`
-	SourceInfo    map[string]SourceInfo  `json:"sources"`
-	StorePaths    map[string]*CacheEntry `json:"store_paths"`
+	Flakes        map[string]FlakeInfo   `json:"flakes,omitempty"`
+	SourceInfo    map[string]SourceInfo  `json:"sources,omitempty"`
+	StorePaths    map[string]*CacheEntry `json:"store_paths,omitempty"`
+
+	// Root, if set, is the workspace directory. NAR URLs from local caches
+	// inside it are recorded relative to it, so the lockfile works in any
+	// checkout; the module extension resolves them against the workspace.
+	Root string `json:"-"`
+
+	// MigratedFrom is the schema version the lockfile was upgraded from
+	// when it was loaded, or 0 if it was already current.
+	MigratedFrom int `json:"-"`
+
+	// loadedFrom is the path the lockfile was last loaded from or saved
+	// to, and loaded that file's info then (nil if it did not exist).
+	loadedFrom string
+	loaded     os.FileInfo
 }
 
 // FlakeInfo contains info about a resolved flake.
+//
+// A flake evaluated for the host only describes its output in the fields
+// below. A flake evaluated for several systems leaves them unset and lists
+// one SystemOutput per Nix system (e.g. "x86_64-linux") in Systems.
 type FlakeInfo struct {
+	DrvHash         string                  `json:"drv_hash,omitempty"`
+	Deps            []string                `json:"deps,omitempty"`              // Build deps (other flakes)
+	OutputStorePath string                  `json:"output_store_path,omitempty"` // Key into StorePaths
+	Executable      string                  `json:"executable,omitempty"`        // Path to executable inside output
+	Env             map[string]string       `json:"env,omitempty"`               // Exported environment variables
+	Closure         []string                `json:"runtime_closure,omitempty"`   // List of keys into StorePaths
+	Systems         map[string]SystemOutput `json:"systems,omitempty"`
+}
+
+// SystemOutput is a flake's output for one Nix system.
+type SystemOutput struct {
 	DrvHash         string            `json:"drv_hash"`
-	Deps            []string          `json:"deps,omitempty"`            // Build deps (other flakes)
-	OutputStorePath string            `json:"output_store_path"`         // Key into StorePaths
-	Executable      string            `json:"executable,omitempty"`      // Path to executable inside output
-	Env             map[string]string `json:"env,omitempty"`             // Exported environment variables
-	Closure         []string          `json:"runtime_closure,omitempty"` // List of keys into StorePaths
+	Deps            []string          `json:"deps,omitempty"`
+	OutputStorePath string            `json:"output_store_path"`
+	Executable      string            `json:"executable,omitempty"`
+	Env             map[string]string `json:"env,omitempty"`
+	Closure         []string          `json:"runtime_closure,omitempty"`
 }
 
-// CacheEntry contains cache.nixos.org info for http_file generation.
+// CacheEntry contains binary cache info for http_file generation.
+//
+// NarHash is the hash of the compressed file at NarURL (the narinfo
+// FileHash) as "<algo>:<hex>"; Integrity is the same hash in SRI form,
+// which Bazel pins the download with. NarContentHash and NarSize
+// describe the decompressed NAR stream and are checked while unpacking.
 type CacheEntry struct {
-	StorePath   string   `json:"store_path"`
-	NarURL      string   `json:"nar_url"`
-	NarHash     string   `json:"nar_hash"`
-	FileSize    int64    `json:"file_size"`
-	Compression string   `json:"compression"`
-	References  []string `json:"references,omitempty"`
+	StorePath      string   `json:"store_path"`
+	CacheURL       string   `json:"cache_url,omitempty"` // Substituter that served the narinfo
+	NarURL         string   `json:"nar_url"`
+	MirrorURLs     []string `json:"mirror_urls,omitempty"` // Fallback download URLs for NarURL
+	NarHash        string   `json:"nar_hash"`
+	Integrity      string   `json:"integrity,omitempty"` // NarHash in SRI form, for Bazel
+	FileSize       int64    `json:"file_size"`
+	Compression    string   `json:"compression"`
+	NarContentHash string   `json:"nar_content_hash,omitempty"`
+	NarSize        int64    `json:"nar_size,omitempty"`
+	References     []string `json:"references,omitempty"`
 }
 
 // SourceInfo contains info for an http_file source.
@@ -42,57 +87,216 @@ type SourceInfo struct {
 	Path      string   `json:"downloaded_file_path,omitempty"`
 }
 
-// LoadLockFile loads a lockfile from disk.
+// LoadLockFile loads a lockfile from disk, merging the fragments of a
+// sharded lockfile, upgrading it to CurrentLockFileVersion and validating
+// it. A missing or empty file yields an empty lockfile.
 func LoadLockFile(path string) (*LockFile, error) {
-	data, err := os.ReadFile(path)
-	if err != nil && !os.IsNotExist(err) {
+	data, info, err := readFileInfo(path)
+	if err != nil {
 		return nil, err
 	}
 
 	if len(data) == 0 {
 		return &LockFile{
-			Version:    1,
+			Version:    CurrentLockFileVersion,
 			Flakes:     make(map[string]FlakeInfo),
 			SourceInfo: make(map[string]SourceInfo),
 			StorePaths: make(map[string]*CacheEntry),
+			loadedFrom: path,
+			loaded:     info,
 		}, nil
 	}
 
-	var lf LockFile
+	lf := LockFile{loadedFrom: path, loaded: info}
 	if err := json.Unmarshal(data, &lf); err != nil {
 		return nil, err
 	}
+	if lf.Layout == LockFileLayoutSharded {
+		if err := lf.loadShards(path); err != nil {
+			return nil, err
+		}
+	}
+	version := lf.Version
+	if err := lf.migrate(); err != nil {
+		return nil, err
+	}
+	if lf.Version != version {
+		lf.MigratedFrom = version
+	}
+	if err := lf.Validate(); err != nil {
+		return nil, err
+	}
+	if lf.Flakes == nil {
+		lf.Flakes = make(map[string]FlakeInfo)
+	}
+	if lf.SourceInfo == nil {
+		lf.SourceInfo = make(map[string]SourceInfo)
+	}
+	if lf.StorePaths == nil {
+		lf.StorePaths = make(map[string]*CacheEntry)
+	}
 	return &lf, nil
 }
 
-// Save writes the lockfile to disk.
+// Save validates the lockfile and atomically replaces the file at path with
+// it, so an interrupted run never leaves a truncated lockfile behind.
+// Concurrent writers are serialized by an advisory lock on path's directory.
+// If the lockfile was loaded from path, Save fails rather than overwrite
+// changes another writer saved there since.
+//
+// A sharded lockfile's fragments are written before its root file; a
+// lockfile saved with the single-file layout removes any old fragments.
 func (lf *LockFile) Save(path string) error {
-	data, err := json.MarshalIndent(lf, "", "  ")
+	if err := lf.Validate(); err != nil {
+		return fmt.Errorf("refusing to write invalid lockfile: %w", err)
+	}
+	root := *lf
+	if lf.Layout == LockFileLayoutSharded {
+		root.Flakes, root.StorePaths = nil, nil
+	}
+	data, err := json.MarshalIndent(&root, "", "  ")
+	if err != nil {
+		return err
+	}
+	unlock, err := lockDir(filepath.Dir(path))
+	if err != nil {
+		return fmt.Errorf("locking %s: %w", path, err)
+	}
+	defer unlock()
+
+	if path == lf.loadedFrom {
+		info, err := os.Stat(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if !sameFileVersion(lf.loaded, info) {
+			return fmt.Errorf("%s was changed by another writer since it was loaded; run again to include those changes", path)
+		}
+	}
+
+	if lf.Layout == LockFileLayoutSharded {
+		if err := lf.saveShards(path); err != nil {
+			return err
+		}
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	if lf.Layout != LockFileLayoutSharded {
+		if err := os.RemoveAll(shardDir(path)); err != nil {
+			return err
+		}
+	}
+	info, err := os.Stat(path)
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(path, data, 0644)
+	lf.loadedFrom, lf.loaded = path, info
+	return nil
 }
 
-// AddStorePath adds a cache entry for a specific store path.
-func (lf *LockFile) AddStorePath(info *NarInfo) {
+// readFileInfo reads the file at path along with its info, both from the
+// same open file so they describe the same version of it. A missing file
+// yields no data and nil info.
+func readFileInfo(path string) ([]byte, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := io.ReadAll(f)
+	return data, info, err
+}
+
+// sameFileVersion reports whether a and b, either of which may be nil for
+// a missing file, describe the same version of a file. Every save replaces
+// the file by rename, so a new version is a new file; the modification time
+// and size guard against its inode number being reused.
+func sameFileVersion(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// lockDir takes an exclusive advisory lock on dir, waiting for other holders
+// to release it. The directory is locked rather than the file because the
+// file is replaced by rename on every write.
+func lockDir(dir string) (unlock func(), err error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// AddStorePath adds a cache entry for a specific store path. A FileHash
+// that is not a valid Nix hash is rejected, since the entry could never be
+// downloaded with it.
+func (lf *LockFile) AddStorePath(info *NarInfo) error {
+	var hash, integrity string
+	if info.FileHash != "" {
+		h, err := ParseHash(info.FileHash)
+		if err != nil {
+			return fmt.Errorf("%s: invalid FileHash: %w", info.StorePath, err)
+		}
+		hash, integrity = h.Algorithm+":"+h.Base16(), h.SRI()
+	}
 	if lf.StorePaths == nil {
 		lf.StorePaths = make(map[string]*CacheEntry)
 	}
 
-	hash := "sha256:" + info.FileHash
-	if hexVal, err := NixHashToHex(info.FileHash); err == nil {
-		hash = "sha256:" + hexVal
+	cacheURL := info.CacheURL
+	if cacheURL == "" {
+		cacheURL = DefaultCacheURL
+	}
+	cacheURL = lf.portableURL(cacheURL)
+	var mirrors []string
+	for _, m := range info.Mirrors {
+		mirrors = append(mirrors, lf.portableURL(m)+"/"+info.URL)
 	}
 
 	lf.StorePaths[info.StorePath] = &CacheEntry{
-		StorePath:   info.StorePath,
-		NarURL:      DefaultCacheURL + "/" + info.URL,
-		NarHash:     hash,
-		FileSize:    info.FileSize,
-		Compression: info.Compression,
-		References:  info.References,
+		StorePath:      info.StorePath,
+		CacheURL:       cacheURL,
+		NarURL:         cacheURL + "/" + info.URL,
+		MirrorURLs:     mirrors,
+		NarHash:        hash,
+		Integrity:      integrity,
+		FileSize:       info.FileSize,
+		Compression:    info.Compression,
+		NarContentHash: info.NarHash,
+		NarSize:        info.NarSize,
+		References:     info.References,
+	}
+	return nil
+}
+
+// portableURL rewrites a file:// URL below lf.Root to a path relative to
+// it. Other URLs are returned unchanged.
+func (lf *LockFile) portableURL(url string) string {
+	if lf.Root == "" || !strings.HasPrefix(url, "file://") {
+		return url
 	}
+	rel, err := filepath.Rel(lf.Root, filepath.FromSlash(strings.TrimPrefix(url, "file://")))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return url
+	}
+	return filepath.ToSlash(rel)
 }
 
 // AddFlake adds a flake entry.
@@ -106,3 +310,37 @@ func (lf *LockFile) AddFlake(label, drvHash, outputStorePath, executable string,
 		Closure:         closure,
 	}
 }
+
+// AddFlakeSystem records the output of a multi-system flake for one system.
+// The flake's other systems are kept; use RetainFlakeSystems to drop
+// systems that are no longer evaluated.
+func (lf *LockFile) AddFlakeSystem(label, system string, out SystemOutput) {
+	flake := lf.Flakes[label]
+	systems := make(map[string]SystemOutput, len(flake.Systems)+1)
+	for s, o := range flake.Systems {
+		systems[s] = o
+	}
+	systems[system] = out
+	lf.Flakes[label] = FlakeInfo{Systems: systems}
+}
+
+// RetainFlakeSystems drops the outputs of label for systems not listed,
+// along with any host-only output recorded before the flake was evaluated
+// for several systems.
+func (lf *LockFile) RetainFlakeSystems(label string, systems []string) {
+	flake, ok := lf.Flakes[label]
+	if !ok {
+		return
+	}
+	kept := make(map[string]SystemOutput)
+	for _, s := range systems {
+		if o, ok := flake.Systems[s]; ok {
+			kept[s] = o
+		}
+	}
+	if len(kept) == 0 {
+		delete(lf.Flakes, label)
+		return
+	}
+	lf.Flakes[label] = FlakeInfo{Systems: kept}
+}
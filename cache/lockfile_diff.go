@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"reflect"
+	"regexp"
+)
+
+// FlakeDiff describes how one flake's closure differs between two
+// lockfiles.
+type FlakeDiff struct {
+	Label string `json:"label"`
+	// System is set for flakes evaluated for several systems; each system
+	// is compared separately.
+	System string `json:"system,omitempty"`
+	// Change is "added", "removed" or "changed".
+	Change   string        `json:"change"`
+	Packages []PackageDiff `json:"packages,omitempty"`
+	// Closure sizes: NarSize is unpacked, FileSize is the download.
+	OldNarSize  int64 `json:"old_nar_size"`
+	NewNarSize  int64 `json:"new_nar_size"`
+	OldFileSize int64 `json:"old_file_size"`
+	NewFileSize int64 `json:"new_file_size"`
+}
+
+// PackageDiff describes one package whose versions or size changed. A nil
+// version list means the package is absent from that closure.
+type PackageDiff struct {
+	Name         string   `json:"name"`
+	OldVersions  []string `json:"old_versions"`
+	NewVersions  []string `json:"new_versions"`
+	NarSizeDelta int64    `json:"nar_size_delta"`
+}
+
+// packageSizeThreshold is the NAR size change below which a package whose
+// versions did not change is not reported, as in `nix store diff-closures`.
+const packageSizeThreshold = 8 * 1024
+
+// outputSuffixRe matches a trailing output name such as "-man" or "-lib".
+var outputSuffixRe = regexp.MustCompile(`^(.*)-([a-z]+|lib32|lib64)$`)
+
+// SplitStoreName splits the name of a store path into a package name and
+// version the way `nix store diff-closures` does. A trailing output name
+// is dropped, then the version starts after the first dash that is not
+// followed by a letter: "glibc-2.40-66" is glibc 2.40-66, and
+// "xgcc-15.2.0-libgcc" is xgcc 15.2.0.
+func SplitStoreName(name string) (pname, version string) {
+	if m := outputSuffixRe.FindStringSubmatch(name); m != nil {
+		name = m[1]
+	}
+	for i := 0; i+1 < len(name); i++ {
+		c := name[i+1]
+		if name[i] == '-' && !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return name[:i], name[i+1:]
+		}
+	}
+	return name, ""
+}
+
+// DiffLockFiles compares the closure of every flake in before and after,
+// per system for multi-system flakes. Flakes whose entries and closures are
+// identical are left out; the result is sorted by label and system.
+func DiffLockFiles(before, after *LockFile) []FlakeDiff {
+	labels := make(map[string]bool)
+	for label := range before.Flakes {
+		labels[label] = true
+	}
+	for label := range after.Flakes {
+		labels[label] = true
+	}
+
+	var diffs []FlakeDiff
+	for _, label := range sortedKeys(labels) {
+		oldOutputs := flakeOutputs(before.Flakes[label])
+		newOutputs := flakeOutputs(after.Flakes[label])
+		systems := make(map[string]bool)
+		for system := range oldOutputs {
+			systems[system] = true
+		}
+		for system := range newOutputs {
+			systems[system] = true
+		}
+
+		for _, system := range sortedKeys(systems) {
+			oldOut, inOld := oldOutputs[system]
+			newOut, inNew := newOutputs[system]
+
+			d := FlakeDiff{Label: label, System: system, Change: "changed"}
+			var oldClosure, newClosure map[string]bool
+			if inOld {
+				oldClosure = before.reachableFrom(before.flakeRoots(oldOut.OutputStorePath, oldOut.Closure, oldOut.Deps))
+				d.OldNarSize, d.OldFileSize = before.closureSize(oldClosure)
+			} else {
+				d.Change = "added"
+			}
+			if inNew {
+				newClosure = after.reachableFrom(after.flakeRoots(newOut.OutputStorePath, newOut.Closure, newOut.Deps))
+				d.NewNarSize, d.NewFileSize = after.closureSize(newClosure)
+			} else {
+				d.Change = "removed"
+			}
+			if inOld && inNew && reflect.DeepEqual(oldOut, newOut) && reflect.DeepEqual(oldClosure, newClosure) {
+				continue
+			}
+			d.Packages = diffPackages(before, oldClosure, after, newClosure)
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+// flakeOutputs returns the outputs of flake by system; a host-only flake
+// has a single output under "".
+func flakeOutputs(flake FlakeInfo) map[string]SystemOutput {
+	if len(flake.Systems) > 0 {
+		return flake.Systems
+	}
+	if flake.OutputStorePath == "" {
+		return nil
+	}
+	return map[string]SystemOutput{"": {
+		DrvHash:         flake.DrvHash,
+		Deps:            flake.Deps,
+		OutputStorePath: flake.OutputStorePath,
+		Executable:      flake.Executable,
+		Env:             flake.Env,
+		Closure:         flake.Closure,
+	}}
+}
+
+// closureSize sums the NAR and download sizes of closure. Paths the
+// lockfile has no entry for count as zero.
+func (lf *LockFile) closureSize(closure map[string]bool) (narSize, fileSize int64) {
+	for p := range closure {
+		if entry, ok := lf.StorePaths[p]; ok {
+			narSize += entry.NarSize
+			fileSize += entry.FileSize
+		}
+	}
+	return narSize, fileSize
+}
+
+// packageInfo aggregates the store paths of one package in a closure.
+type packageInfo struct {
+	versions map[string]bool
+	narSize  int64
+}
+
+func (lf *LockFile) packages(closure map[string]bool) map[string]*packageInfo {
+	pkgs := make(map[string]*packageInfo)
+	for p := range closure {
+		pname, version := SplitStoreName(StoreName(p))
+		pkg, ok := pkgs[pname]
+		if !ok {
+			pkg = &packageInfo{versions: make(map[string]bool)}
+			pkgs[pname] = pkg
+		}
+		pkg.versions[version] = true
+		if entry, ok := lf.StorePaths[p]; ok {
+			pkg.narSize += entry.NarSize
+		}
+	}
+	return pkgs
+}
+
+func diffPackages(before *LockFile, oldClosure map[string]bool, after *LockFile, newClosure map[string]bool) []PackageDiff {
+	oldPkgs := before.packages(oldClosure)
+	newPkgs := after.packages(newClosure)
+	names := make(map[string]bool)
+	for name := range oldPkgs {
+		names[name] = true
+	}
+	for name := range newPkgs {
+		names[name] = true
+	}
+
+	var diffs []PackageDiff
+	for _, name := range sortedKeys(names) {
+		d := PackageDiff{Name: name}
+		if pkg, ok := oldPkgs[name]; ok {
+			d.OldVersions = sortedKeys(pkg.versions)
+			d.NarSizeDelta -= pkg.narSize
+		}
+		if pkg, ok := newPkgs[name]; ok {
+			d.NewVersions = sortedKeys(pkg.versions)
+			d.NarSizeDelta += pkg.narSize
+		}
+		versionsChanged := !reflect.DeepEqual(d.OldVersions, d.NewVersions)
+		if versionsChanged || d.NarSizeDelta > packageSizeThreshold || d.NarSizeDelta < -packageSizeThreshold {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
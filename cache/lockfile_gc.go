@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"sort"
+	"strings"
+)
+
+// PruneReport lists what LockFile.Prune removed, sorted.
+type PruneReport struct {
+	Flakes     []string
+	StorePaths []string
+}
+
+// Prune removes the flakes keepFlake rejects, then every store path no
+// remaining flake can reach; see Reachable.
+func (lf *LockFile) Prune(keepFlake func(label string) bool) PruneReport {
+	var report PruneReport
+	for label := range lf.Flakes {
+		if !keepFlake(label) {
+			delete(lf.Flakes, label)
+			report.Flakes = append(report.Flakes, label)
+		}
+	}
+	reachable := lf.Reachable()
+	for p := range lf.StorePaths {
+		if !reachable[p] {
+			delete(lf.StorePaths, p)
+			report.StorePaths = append(report.StorePaths, p)
+		}
+	}
+	sort.Strings(report.Flakes)
+	sort.Strings(report.StorePaths)
+	return report
+}
+
+// Reachable returns the store paths the flakes need: their outputs,
+// runtime closures and store path deps ("@<cache>//:s_<hash>" labels) for
+// every system, plus everything those reference transitively.
+func (lf *LockFile) Reachable() map[string]bool {
+	var roots []string
+	for _, flake := range lf.Flakes {
+		roots = append(roots, lf.flakeRoots(flake.OutputStorePath, flake.Closure, flake.Deps)...)
+		for _, out := range flake.Systems {
+			roots = append(roots, lf.flakeRoots(out.OutputStorePath, out.Closure, out.Deps)...)
+		}
+	}
+	return lf.reachableFrom(roots)
+}
+
+// flakeRoots returns the store paths a flake output refers to directly.
+func (lf *LockFile) flakeRoots(output string, closure, deps []string) []string {
+	roots := append([]string{output}, closure...)
+	for _, dep := range deps {
+		i := strings.LastIndex(dep, ":s_")
+		if i < 0 {
+			continue
+		}
+		hash := dep[i+len(":s_"):]
+		for p := range lf.StorePaths {
+			if StoreHash(p) == hash {
+				roots = append(roots, p)
+				break
+			}
+		}
+	}
+	return roots
+}
+
+// reachableFrom returns roots and every store path they reference
+// transitively through lf.StorePaths.
+func (lf *LockFile) reachableFrom(roots []string) map[string]bool {
+	queue := append([]string(nil), roots...)
+	reachable := make(map[string]bool)
+	for len(queue) > 0 {
+		p := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if p == "" || reachable[p] {
+			continue
+		}
+		reachable[p] = true
+		if entry, ok := lf.StorePaths[p]; ok {
+			for _, ref := range entry.References {
+				queue = append(queue, fullStorePath(ref))
+			}
+		}
+	}
+	return reachable
+}
@@ -0,0 +1,245 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// CurrentLockFileVersion is the lockfile schema version written by this
+// package. Older versions are upgraded on load by lockFileMigrations.
+//
+// Version history:
+//
+//	1: original schema; nar_hash may be in any encoding and integrity is
+//	   optional.
+//	2: every store path entry has nar_hash as "<algo>:<hex>" and an SRI
+//	   integrity, and is keyed by its own store_path.
+//	3: adds layout; a sharded lockfile keeps its flakes and store paths in
+//	   fragments that older readers would not see.
+//	4: adds per-system flake outputs; a multi-system flake has no top-level
+//	   output_store_path.
+const CurrentLockFileVersion = 4
+
+// lockFileMigrations maps a schema version to the function that upgrades a
+// lockfile from it to the next version.
+var lockFileMigrations = map[int]func(*LockFile) error{
+	1: migrateLockFileV1,
+	2: func(*LockFile) error { return nil },
+	3: func(*LockFile) error { return nil },
+}
+
+// migrate upgrades lf to CurrentLockFileVersion.
+func (lf *LockFile) migrate() error {
+	switch {
+	case lf.Version == 0:
+		return fmt.Errorf("lockfile has no schema version; regenerate it with Gazelle")
+	case lf.Version > CurrentLockFileVersion:
+		return fmt.Errorf("lockfile schema version %d is newer than the newest supported version %d; upgrade nix-bazel-via-bwrap", lf.Version, CurrentLockFileVersion)
+	}
+	for lf.Version < CurrentLockFileVersion {
+		migration, ok := lockFileMigrations[lf.Version]
+		if !ok {
+			return fmt.Errorf("lockfile schema version %d can no longer be upgraded; regenerate it with Gazelle", lf.Version)
+		}
+		if err := migration(lf); err != nil {
+			return fmt.Errorf("upgrading lockfile from schema version %d: %w", lf.Version, err)
+		}
+		lf.Version++
+	}
+	return nil
+}
+
+// migrateLockFileV1 normalizes nar_hash and derives integrity from it.
+// Version 1 lockfiles written by early releases could carry a base32 digest,
+// sometimes behind a doubled "sha256:" prefix.
+func migrateLockFileV1(lf *LockFile) error {
+	for p, entry := range lf.StorePaths {
+		if entry == nil {
+			return fmt.Errorf("store path %s: empty entry", p)
+		}
+		if entry.StorePath == "" {
+			entry.StorePath = p
+		}
+		h, err := ParseHash(entry.NarHash)
+		if err != nil {
+			h, err = ParseHash(strings.TrimPrefix(entry.NarHash, "sha256:"))
+		}
+		if err != nil {
+			return fmt.Errorf("store path %s: nar_hash: %w", p, err)
+		}
+		entry.NarHash = h.Algorithm + ":" + h.Base16()
+		entry.Integrity = h.SRI()
+	}
+	return nil
+}
+
+// Validate checks lf against CurrentLockFileVersion, reporting every
+// problem found along with the flake, store path or source it concerns.
+func (lf *LockFile) Validate() error {
+	if lf.Version != CurrentLockFileVersion {
+		return fmt.Errorf("lockfile schema version is %d, want %d", lf.Version, CurrentLockFileVersion)
+	}
+	if lf.Layout != "" && lf.Layout != LockFileLayoutSharded {
+		return fmt.Errorf("unknown lockfile layout %q", lf.Layout)
+	}
+	var errs []error
+	for p, entry := range lf.StorePaths {
+		if err := validateCacheEntry(p, entry); err != nil {
+			errs = append(errs, fmt.Errorf("store path %s: %w", p, err))
+			continue
+		}
+		for _, ref := range entry.References {
+			if _, ok := lf.StorePaths[fullStorePath(ref)]; !ok {
+				errs = append(errs, fmt.Errorf("store path %s: reference %s is not locked", p, ref))
+			}
+		}
+	}
+	for label, flake := range lf.Flakes {
+		if err := lf.validateFlake(label, flake); err != nil {
+			errs = append(errs, fmt.Errorf("flake %s: %w", label, err))
+		}
+	}
+	for name, src := range lf.SourceInfo {
+		if len(src.URLs) == 0 {
+			errs = append(errs, fmt.Errorf("source %s: no urls", name))
+		} else if src.Sha256 == "" && src.Integrity == "" {
+			errs = append(errs, fmt.Errorf("source %s: neither sha256 nor integrity is set", name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func validateCacheEntry(key string, entry *CacheEntry) error {
+	if entry == nil {
+		return fmt.Errorf("empty entry")
+	}
+	if _, err := ParseStorePath(key); err != nil {
+		return err
+	}
+	if entry.StorePath != key {
+		return fmt.Errorf("store_path is %q", entry.StorePath)
+	}
+	if entry.NarURL == "" {
+		return fmt.Errorf("nar_url is not set")
+	}
+	h, err := ParseHash(entry.NarHash)
+	if err != nil {
+		return fmt.Errorf("nar_hash: %w", err)
+	}
+	if entry.NarHash != h.Algorithm+":"+h.Base16() {
+		return fmt.Errorf("nar_hash %q is not in <algo>:<hex> form", entry.NarHash)
+	}
+	integrity, err := ParseHash(entry.Integrity)
+	if err != nil {
+		return fmt.Errorf("integrity: %w", err)
+	}
+	if !integrity.Equal(h) {
+		return fmt.Errorf("integrity %s does not match nar_hash %s", entry.Integrity, entry.NarHash)
+	}
+	if entry.FileSize < 0 || entry.NarSize < 0 {
+		return fmt.Errorf("negative size")
+	}
+	// An empty compression means bzip2, as in narinfo.
+	if entry.Compression != "" && entry.Compression != "none" && CompressionExtension(entry.Compression) == "" {
+		return fmt.Errorf("unsupported compression %q", entry.Compression)
+	}
+	if entry.NarContentHash != "" {
+		if _, err := ParseHash(entry.NarContentHash); err != nil {
+			return fmt.Errorf("nar_content_hash: %w", err)
+		}
+	}
+	for _, ref := range entry.References {
+		if _, err := ParseStorePath(fullStorePath(ref)); err != nil {
+			return fmt.Errorf("references: %w", err)
+		}
+	}
+	return nil
+}
+
+// validateLabel checks that label is "//<package>:<name>" with a package
+// that stays inside the workspace.
+func validateLabel(label string) error {
+	pkg, name, ok := strings.Cut(strings.TrimPrefix(label, "//"), ":")
+	if !strings.HasPrefix(label, "//") || !ok || name == "" {
+		return fmt.Errorf("not an absolute label")
+	}
+	if pkg != "" {
+		for _, part := range strings.Split(pkg, "/") {
+			if part == "" || part == "." || part == ".." {
+				return fmt.Errorf("invalid package %q", pkg)
+			}
+		}
+	}
+	return nil
+}
+
+func (lf *LockFile) validateFlake(label string, flake FlakeInfo) error {
+	if err := validateLabel(label); err != nil {
+		return err
+	}
+	if len(flake.Systems) == 0 {
+		return lf.validateFlakeOutput(flake.OutputStorePath, flake.Executable, flake.Closure, flake.Deps)
+	}
+	if flake.OutputStorePath != "" || flake.DrvHash != "" || flake.Executable != "" || len(flake.Closure) > 0 {
+		return fmt.Errorf("both a host output and per-system outputs are set")
+	}
+	for system, out := range flake.Systems {
+		if !nixSystemRe.MatchString(system) {
+			return fmt.Errorf("invalid system %q", system)
+		}
+		if err := lf.validateFlakeOutput(out.OutputStorePath, out.Executable, out.Closure, out.Deps); err != nil {
+			return fmt.Errorf("system %s: %w", system, err)
+		}
+	}
+	return nil
+}
+
+// nixSystemRe matches Nix system names such as "x86_64-linux".
+var nixSystemRe = regexp.MustCompile(`^[a-z0-9_]+-[a-z]+$`)
+
+// validateFlakeOutput checks one output of a flake, including that every
+// store path it names, directly or through a "@<cache>//:s_<hash>" dep, is
+// locked; the module extension could not fetch it otherwise. The output
+// itself is the exception: one in no substituter, e.g. only built locally,
+// is not locked, and the module extension skips it.
+func (lf *LockFile) validateFlakeOutput(outputStorePath, executable string, closure, deps []string) error {
+	if _, err := ParseStorePath(outputStorePath); err != nil {
+		return fmt.Errorf("output_store_path: %w", err)
+	}
+	if exe := executable; exe != "" {
+		if path.IsAbs(exe) || path.Clean(exe) != exe || exe == ".." || strings.HasPrefix(exe, "../") {
+			return fmt.Errorf("executable %q is not a relative path inside the output", exe)
+		}
+	}
+	for _, p := range closure {
+		if _, err := ParseStorePath(p); err != nil {
+			return fmt.Errorf("runtime_closure: %w", err)
+		}
+		if _, ok := lf.StorePaths[p]; !ok && p != outputStorePath {
+			return fmt.Errorf("runtime_closure member %s is not locked", p)
+		}
+	}
+	for _, dep := range deps {
+		i := strings.LastIndex(dep, ":s_")
+		if i < 0 {
+			continue
+		}
+		if !lf.hasStoreHash(dep[i+len(":s_"):]) {
+			return fmt.Errorf("dep %s names a store path that is not locked", dep)
+		}
+	}
+	return nil
+}
+
+// hasStoreHash reports whether a locked store path has the given hash.
+func (lf *LockFile) hasStoreHash(hash string) bool {
+	for p := range lf.StorePaths {
+		if StoreHash(p) == hash {
+			return true
+		}
+	}
+	return false
+}
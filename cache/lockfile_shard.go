@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LockFileLayoutSharded stores a lockfile as a small root file plus
+// fragments, so unrelated changes touch unrelated files:
+//
+//	nix.lock                               version, layout, nixpkgs_commit, sources
+//	nix.lock.d/flakes/<package>/lock.json  the flakes of one Bazel package
+//	nix.lock.d/store_paths/<base>.json     one CacheEntry per store path
+//
+// Store path entries are named after the store path they describe, so two
+// changes adding the same path write identical files. LoadLockFile merges
+// the fragments and Save splits them again; callers see a single LockFile
+// either way. The empty layout is a single self-contained file.
+const LockFileLayoutSharded = "sharded"
+
+// shardDir returns the directory holding the fragments of the lockfile at
+// path.
+func shardDir(path string) string {
+	return path + ".d"
+}
+
+// flakeFragmentPath returns the fragment holding the flake label, which
+// must be a validated "//<package>:<name>" label.
+func flakeFragmentPath(dir, label string) string {
+	pkg, _, _ := strings.Cut(strings.TrimPrefix(label, "//"), ":")
+	return filepath.Join(dir, "flakes", filepath.FromSlash(pkg), "lock.json")
+}
+
+// storePathIndexPath returns the index entry of storePath.
+func storePathIndexPath(dir, storePath string) string {
+	return filepath.Join(dir, "store_paths", StoreBaseName(storePath)+".json")
+}
+
+// loadShards merges the fragments of the sharded lockfile at path into lf.
+func (lf *LockFile) loadShards(path string) error {
+	if len(lf.Flakes) > 0 || len(lf.StorePaths) > 0 {
+		return fmt.Errorf("sharded lockfile %s must not list flakes or store paths itself", path)
+	}
+	dir := shardDir(path)
+	// The fragment directory exists even when it is empty, so a missing
+	// one means the lockfile was only partly checked in or copied.
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("sharded lockfile %s: fragment directory: %w", path, err)
+	}
+	lf.Flakes = make(map[string]FlakeInfo)
+	lf.StorePaths = make(map[string]*CacheEntry)
+
+	err := filepath.WalkDir(filepath.Join(dir, "flakes"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != "lock.json" {
+			return err
+		}
+		var flakes map[string]FlakeInfo
+		if err := readJSON(p, &flakes); err != nil {
+			return err
+		}
+		for label, flake := range flakes {
+			if err := validateLabel(label); err != nil {
+				return fmt.Errorf("%s: flake %s: %w", p, label, err)
+			}
+			if flakeFragmentPath(dir, label) != p {
+				return fmt.Errorf("%s: flake %s belongs in %s", p, label, flakeFragmentPath(dir, label))
+			}
+			lf.Flakes[label] = flake
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	entries, err := os.ReadDir(filepath.Join(dir, "store_paths"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		p := filepath.Join(dir, "store_paths", e.Name())
+		var entry CacheEntry
+		if err := readJSON(p, &entry); err != nil {
+			return err
+		}
+		if storePathIndexPath(dir, entry.StorePath) != p {
+			return fmt.Errorf("%s: entry is for store path %q", p, entry.StorePath)
+		}
+		lf.StorePaths[entry.StorePath] = &entry
+	}
+	return nil
+}
+
+// saveShards writes the fragments of lf next to path and removes fragments
+// it no longer needs. Unchanged fragments are left alone.
+func (lf *LockFile) saveShards(path string) error {
+	dir := shardDir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	want := make(map[string][]byte)
+
+	fragments := make(map[string]map[string]FlakeInfo)
+	for label, flake := range lf.Flakes {
+		p := flakeFragmentPath(dir, label)
+		if fragments[p] == nil {
+			fragments[p] = make(map[string]FlakeInfo)
+		}
+		fragments[p][label] = flake
+	}
+	for p, flakes := range fragments {
+		data, err := json.MarshalIndent(flakes, "", "  ")
+		if err != nil {
+			return err
+		}
+		want[p] = data
+	}
+	for storePath, entry := range lf.StorePaths {
+		data, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return err
+		}
+		want[storePathIndexPath(dir, storePath)] = data
+	}
+
+	for p, data := range want {
+		if old, err := os.ReadFile(p); err == nil && bytes.Equal(old, data) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(p, data); err != nil {
+			return err
+		}
+	}
+	return removeStaleFragments(dir, want)
+}
+
+// removeStaleFragments deletes files under dir that are not in keep, and
+// any directories left empty.
+func removeStaleFragments(dir string, keep map[string][]byte) error {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, p)
+			return nil
+		}
+		if _, ok := keep[p]; !ok {
+			return os.Remove(p)
+		}
+		return nil
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	// Walk order lists parents first; remove children first. Removing a
+	// non-empty directory fails, which is fine.
+	for i := len(dirs) - 1; i > 0; i-- {
+		os.Remove(dirs[i])
+	}
+	return nil
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testLockV1 = `{
+  "version": 1,
+  "flakes": {
+    "//hello:default": {
+      "drv_hash": "72pl0rs7xi7vsniia10p7q8vl7f36xaw",
+      "output_store_path": "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2",
+      "executable": "bin/hello",
+      "runtime_closure": ["/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2"]
+    }
+  },
+  "store_paths": {
+    "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2": {
+      "nar_url": "https://cache.nixos.org/nar/07j1yq4jb2r1xyi9lr35kr69wj9vb19cnwpk1rzzczj9n6fx3wha.nar.xz",
+      "nar_hash": "sha256:sha256:07j1yq4jb2r1xyi9lr35kr69wj9vb19cnwpk1rzzczj9n6fx3wha",
+      "file_size": 72904,
+      "compression": "xz"
+    }
+  }
+}`
+
+func writeLock(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nix.lock")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLockFileMigratesV1(t *testing.T) {
+	path := writeLock(t, testLockV1)
+	lf, err := LoadLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lf.Version != CurrentLockFileVersion || lf.MigratedFrom != 1 {
+		t.Errorf("Version, MigratedFrom = %d, %d", lf.Version, lf.MigratedFrom)
+	}
+	entry := lf.StorePaths["/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2"]
+	h, _ := ParseHash("sha256:07j1yq4jb2r1xyi9lr35kr69wj9vb19cnwpk1rzzczj9n6fx3wha")
+	if entry.StorePath == "" || entry.NarHash != "sha256:"+h.Base16() || entry.Integrity != h.SRI() {
+		t.Errorf("migrated entry = %+v", entry)
+	}
+
+	if err := lf.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	lf, err = LoadLockFile(path)
+	if err != nil || lf.MigratedFrom != 0 {
+		t.Errorf("reloading migrated lockfile: MigratedFrom = %d, err = %v", lf.MigratedFrom, err)
+	}
+}
+
+// TestLoadBaselineLockFile loads the v1 lockfile the repository shipped
+// with, whose cache_miss flake has an output that is in no substituter.
+func TestLoadBaselineLockFile(t *testing.T) {
+	const uncached = "/nix/store/y444cql8qq65srq29i2jlrgq26amb227-simple-drv"
+	for _, path := range []string{"testdata/baseline.lock", "../nix_deps/nix.lock"} {
+		lf, err := LoadLockFile(path)
+		if err != nil {
+			t.Fatalf("LoadLockFile(%s): %v", path, err)
+		}
+		flake := lf.Flakes["//tests/manual/cache_miss:default"]
+		if _, locked := lf.StorePaths[uncached]; flake.OutputStorePath != uncached || locked {
+			t.Errorf("%s: cache_miss flake = %+v, locked = %v", path, flake, locked)
+		}
+		if err := lf.Save(filepath.Join(t.TempDir(), "nix.lock")); err != nil {
+			t.Errorf("%s: Save: %v", path, err)
+		}
+	}
+}
+
+func TestLoadLockFileRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name, content, want string
+	}{
+		{"unversioned", `{"flakes": {}}`, "no schema version"},
+		{"future", `{"version": 99}`, "newer than"},
+		{"bad hash", strings.Replace(testLockV1, "sha256:sha256:07j1", "sha256:zz", 1),
+			"store path /nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2"},
+		{"bad closure", strings.Replace(testLockV1, `"runtime_closure": ["/nix/store/`, `"runtime_closure": ["/usr/`, 1),
+			"flake //hello:default: runtime_closure"},
+		{"escaping executable", strings.Replace(testLockV1, "bin/hello", "../../etc/passwd", 1),
+			"flake //hello:default: executable"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadLockFile(writeLock(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadLockFile error = %v; want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSaveRejectsInvalidLockFile(t *testing.T) {
+	lf, err := LoadLockFile(filepath.Join(t.TempDir(), "missing.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.AddFlake("//hello:default", "", "not-a-store-path", "", nil, nil, nil)
+	path := filepath.Join(t.TempDir(), "nix.lock")
+	if err := lf.Save(path); err == nil {
+		t.Error("Save accepted a flake with an invalid output path")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("invalid lockfile was written: %v", err)
+	}
+}
+
+func TestSaveConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nix.lock")
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lf, _ := LoadLockFile(filepath.Join(dir, "missing.lock"))
+			lf.NixpkgsCommit = strings.Repeat("x", 1000*(i+1))
+			errs <- lf.Save(path)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := LoadLockFile(path); err != nil {
+		t.Errorf("lockfile is corrupt after concurrent saves: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory contains %d entries, want only nix.lock", len(entries))
+	}
+}
+
+func TestSaveDetectsConcurrentChange(t *testing.T) {
+	path := writeLock(t, testLockV1)
+	ours, err := LoadLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := LoadLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs.NixpkgsCommit = "theirs"
+	if err := theirs.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	// Saving again only replaces what this lockfile itself wrote.
+	if err := theirs.Save(path); err != nil {
+		t.Fatalf("second Save: %v", err)
+	}
+
+	ours.NixpkgsCommit = "ours"
+	if err := ours.Save(path); err == nil || !strings.Contains(err.Error(), "changed by another writer") {
+		t.Errorf("Save over a changed lockfile = %v; want an error", err)
+	}
+	if lf, err := LoadLockFile(path); err != nil || lf.NixpkgsCommit != "theirs" {
+		t.Errorf("lockfile after the rejected Save: %v, %v", lf, err)
+	}
+	// Saving elsewhere is unaffected.
+	if err := ours.Save(filepath.Join(t.TempDir(), "nix.lock")); err != nil {
+		t.Errorf("Save to another path: %v", err)
+	}
+}
+
+func TestShardedLockFile(t *testing.T) {
+	lf, err := LoadLockFile(writeLock(t, testLockV1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.AddFlake("//tools/hello:default", "72pl0rs7xi7vsniia10p7q8vl7f36xaw", "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2", "", nil, nil, nil)
+	lf.Layout = LockFileLayoutSharded
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nix.lock")
+	if err := lf.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{
+		"nix.lock.d/flakes/hello/lock.json",
+		"nix.lock.d/flakes/tools/hello/lock.json",
+		"nix.lock.d/store_paths/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2.json",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+			t.Errorf("fragment missing: %v", err)
+		}
+	}
+	root, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(root), "store_paths") || strings.Contains(string(root), "flakes") {
+		t.Errorf("sharded root file lists entries:\n%s", root)
+	}
+
+	merged, err := LoadLockFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(merged.Flakes, lf.Flakes) || !reflect.DeepEqual(merged.StorePaths, lf.StorePaths) {
+		t.Errorf("merged lockfile differs from the saved one")
+	}
+
+	// A root file without its fragments is not mistaken for an empty lockfile.
+	moved := filepath.Join(dir, "moved")
+	if err := os.Rename(filepath.Join(dir, "nix.lock.d"), moved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLockFile(path); err == nil {
+		t.Error("LoadLockFile without the fragment directory succeeded")
+	}
+	if err := os.Rename(moved, filepath.Join(dir, "nix.lock.d")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dropping a flake removes its fragment and the emptied directories.
+	delete(merged.Flakes, "//tools/hello:default")
+	if err := merged.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nix.lock.d/flakes/tools")); !os.IsNotExist(err) {
+		t.Errorf("stale fragment directory remains: %v", err)
+	}
+
+	// A fragment in the wrong package is rejected.
+	misplaced := filepath.Join(dir, "nix.lock.d/flakes/other/lock.json")
+	os.MkdirAll(filepath.Dir(misplaced), 0755)
+	os.WriteFile(misplaced, []byte(`{"//hello:default": {"output_store_path": "`+testSelf+`"}}`), 0644)
+	if _, err := LoadLockFile(path); err == nil || !strings.Contains(err.Error(), "belongs in") {
+		t.Errorf("LoadLockFile with misplaced fragment: %v", err)
+	}
+	os.Remove(misplaced)
+
+	// Converting back to a single file removes the fragments.
+	merged.Layout = ""
+	if err := merged.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "nix.lock.d")); !os.IsNotExist(err) {
+		t.Errorf("fragments remain after switching to a single file: %v", err)
+	}
+	single, err := LoadLockFile(path)
+	if err != nil || len(single.Flakes) != 1 || len(single.StorePaths) != 1 {
+		t.Errorf("single-file lockfile = %+v, %v", single, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	const (
+		glibc  = "/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-glibc-2.40-66"
+		libgcc = "/nix/store/6h39qxzrm4i1fhl538knvyjapcdyasfx-xgcc-15.2.0-libgcc"
+		bash   = "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-bash-5.2p37"
+		orphan = "/nix/store/hlcdbvwjlzjd2x86fxghzj1gpzplccqw-libunistring-1.4.1"
+		gone   = "/nix/store/y444cql8qq65srq29i2jlrgq26amb227-simple-drv"
+	)
+	lf := &LockFile{Flakes: map[string]FlakeInfo{}, StorePaths: map[string]*CacheEntry{}}
+	for _, p := range []string{testSelf, glibc, libgcc, bash, orphan, gone} {
+		lf.StorePaths[p] = &CacheEntry{StorePath: p}
+	}
+	lf.StorePaths[glibc].References = []string{StoreBaseName(libgcc)}
+	lf.AddFlake("//hello:default", "", testSelf, "", nil,
+		[]string{"@nix_cache//:s_" + StoreHash(bash)}, []string{testSelf, glibc})
+	lf.AddFlake("//removed:default", "", gone, "", nil, nil, []string{gone})
+
+	report := lf.Prune(func(label string) bool { return label != "//removed:default" })
+	if want := []string{"//removed:default"}; !reflect.DeepEqual(report.Flakes, want) {
+		t.Errorf("pruned flakes = %v; want %v", report.Flakes, want)
+	}
+	if want := []string{orphan, gone}; !reflect.DeepEqual(report.StorePaths, want) {
+		t.Errorf("pruned store paths = %v; want %v", report.StorePaths, want)
+	}
+	for _, p := range []string{testSelf, glibc, libgcc, bash} {
+		if lf.StorePaths[p] == nil {
+			t.Errorf("reachable store path %s was pruned", p)
+		}
+	}
+}
+
+func TestSplitStoreName(t *testing.T) {
+	for _, tt := range []struct{ name, pname, version string }{
+		{"hello-2.12.2", "hello", "2.12.2"},
+		{"glibc-2.40-66", "glibc", "2.40-66"},
+		{"xgcc-15.2.0-libgcc", "xgcc", "15.2.0"},
+		{"bash-interactive-5.2p37-man", "bash-interactive", "5.2p37"},
+		{"default-builder.sh", "default-builder.sh", ""},
+	} {
+		pname, version := SplitStoreName(tt.name)
+		if pname != tt.pname || version != tt.version {
+			t.Errorf("SplitStoreName(%q) = %q, %q; want %q, %q", tt.name, pname, version, tt.pname, tt.version)
+		}
+	}
+}
+
+func TestDiffLockFiles(t *testing.T) {
+	const (
+		glibcOld = "/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-glibc-2.39-52"
+		glibcNew = "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-glibc-2.40-66"
+		idn      = "/nix/store/hlcdbvwjlzjd2x86fxghzj1gpzplccqw-libidn2-2.3.8"
+	)
+	lock := func(closure ...string) *LockFile {
+		lf := &LockFile{Flakes: map[string]FlakeInfo{}, StorePaths: map[string]*CacheEntry{}}
+		for i, p := range closure {
+			lf.StorePaths[p] = &CacheEntry{StorePath: p, NarSize: int64(i+1) << 20, FileSize: 1 << 10}
+		}
+		lf.AddFlake("//hello:default", "", closure[0], "bin/hello", nil, nil, closure)
+		return lf
+	}
+	before := lock(testSelf, glibcOld)
+	before.AddFlake("//same:default", "", testSelf, "", nil, nil, []string{testSelf})
+	after := lock(testSelf, glibcNew, idn)
+	after.AddFlake("//same:default", "", testSelf, "", nil, nil, []string{testSelf})
+	after.AddFlake("//new:default", "", idn, "", nil, nil, []string{idn})
+
+	diffs := DiffLockFiles(before, after)
+	if len(diffs) != 2 || diffs[0].Label != "//hello:default" || diffs[1].Label != "//new:default" {
+		t.Fatalf("DiffLockFiles = %+v", diffs)
+	}
+	hello := diffs[0]
+	if hello.Change != "changed" || hello.OldNarSize != 3<<20 || hello.NewNarSize != 6<<20 {
+		t.Errorf("hello = %+v", hello)
+	}
+	want := []PackageDiff{
+		{Name: "glibc", OldVersions: []string{"2.39-52"}, NewVersions: []string{"2.40-66"}},
+		{Name: "libidn2", NewVersions: []string{"2.3.8"}, NarSizeDelta: 3 << 20},
+	}
+	if !reflect.DeepEqual(hello.Packages, want) {
+		t.Errorf("hello packages = %+v; want %+v", hello.Packages, want)
+	}
+	if diffs[1].Change != "added" {
+		t.Errorf("new flake change = %q", diffs[1].Change)
+	}
+}
+
+func TestMultiSystemFlake(t *testing.T) {
+	const (
+		hostOut = "/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-hello-2.12.2"
+		armOut  = "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-hello-2.12.2"
+		darwin  = "/nix/store/hlcdbvwjlzjd2x86fxghzj1gpzplccqw-hello-2.12.2"
+	)
+	lf, err := LoadLockFile(filepath.Join(t.TempDir(), "missing.lock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{hostOut, armOut, darwin} {
+		h := Hash{Algorithm: "sha256", Digest: make([]byte, 32)}
+		lf.StorePaths[p] = &CacheEntry{StorePath: p, NarURL: "nar/x.nar", NarHash: "sha256:" + h.Base16(), Integrity: h.SRI()}
+	}
+	lf.AddFlakeSystem("//hello:default", "x86_64-linux", SystemOutput{OutputStorePath: hostOut, Executable: "bin/hello", Closure: []string{hostOut}})
+	lf.AddFlakeSystem("//hello:default", "aarch64-linux", SystemOutput{OutputStorePath: armOut, Executable: "bin/hello", Closure: []string{armOut}})
+	lf.AddFlakeSystem("//hello:default", "x86_64-darwin", SystemOutput{OutputStorePath: darwin, Executable: "bin/hello", Closure: []string{darwin}})
+	if err := lf.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	before := *lf
+	before.Flakes = map[string]FlakeInfo{"//hello:default": lf.Flakes["//hello:default"]}
+	lf.RetainFlakeSystems("//hello:default", []string{"x86_64-linux", "aarch64-linux"})
+	if got := len(lf.Flakes["//hello:default"].Systems); got != 2 {
+		t.Fatalf("RetainFlakeSystems kept %d systems; want 2", got)
+	}
+	if report := lf.Prune(func(string) bool { return true }); !reflect.DeepEqual(report.StorePaths, []string{darwin}) {
+		t.Errorf("pruned store paths = %v; want [%s]", report.StorePaths, darwin)
+	}
+	diffs := DiffLockFiles(&before, lf)
+	if len(diffs) != 1 || diffs[0].System != "x86_64-darwin" || diffs[0].Change != "removed" {
+		t.Errorf("DiffLockFiles = %+v", diffs)
+	}
+
+	bad := lf.Flakes["//hello:default"]
+	bad.OutputStorePath = hostOut
+	lf.Flakes["//bad:host"] = bad
+	lf.Flakes["//bad:system"] = FlakeInfo{Systems: map[string]SystemOutput{"linux": {OutputStorePath: hostOut}}}
+	err = lf.Validate()
+	for _, want := range []string{"//bad:host: both a host output and per-system outputs", `//bad:system: invalid system "linux"`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v; want %q", err, want)
+		}
+	}
+
+	lf.RetainFlakeSystems("//hello:default", nil)
+	if _, ok := lf.Flakes["//hello:default"]; ok {
+		t.Error("flake with no remaining systems was kept")
+	}
+}
+
+func TestValidateCrossReferences(t *testing.T) {
+	const (
+		hello   = "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2"
+		missing = "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-glibc-2.40"
+		other   = "/nix/store/hlcdbvwjlzjd2x86fxghzj1gpzplccqw-zlib-1.3.1"
+	)
+	lf, err := LoadLockFile(writeLock(t, testLockV1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.AddFlake("//dep:default", "", hello, "", nil, []string{"@nix_cache//:s_i3zw7h6pg3n9r5i63iyqxrapa70i4v5w"}, []string{hello})
+	// An output in no substituter is not locked.
+	lf.AddFlake("//uncached:default", "", missing, "", nil, nil, []string{missing})
+	lf.AddFlakeSystem("//uncached_system:default", "aarch64-linux", SystemOutput{OutputStorePath: missing, Closure: []string{missing}})
+	if err := lf.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	lf.AddFlake("//output:default", "", missing, "", nil, nil, []string{missing, other})
+	lf.AddFlake("//closure:default", "", hello, "", nil, nil, []string{hello, missing})
+	lf.AddFlake("//deps:default", "", hello, "", nil, []string{"@nix_cache//:s_kywwgk85nl83mpf10av3bvm2khdlq5ib"}, nil)
+	lf.AddFlakeSystem("//system:default", "aarch64-linux", SystemOutput{OutputStorePath: missing, Closure: []string{other}})
+	lf.StorePaths[hello].References = []string{StoreBaseName(missing)}
+	err = lf.Validate()
+	for _, want := range []string{
+		"flake //output:default: runtime_closure member " + other + " is not locked",
+		"flake //closure:default: runtime_closure member " + missing + " is not locked",
+		"flake //deps:default: dep @nix_cache//:s_kywwgk85nl83mpf10av3bvm2khdlq5ib names a store path that is not locked",
+		"flake //system:default: system aarch64-linux: runtime_closure member " + other + " is not locked",
+		"store path " + hello + ": reference " + StoreBaseName(missing) + " is not locked",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate = %v; want %q", err, want)
+		}
+	}
+}
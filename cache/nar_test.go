@@ -0,0 +1,377 @@
+package cache
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func TestEncodeNixBase32(t *testing.T) {
+	sum := sha256.Sum256(nil)
+	got := EncodeNixBase32(sum[:])
+	want := "0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73"
+	if got != want {
+		t.Errorf("EncodeNixBase32(sha256(\"\")) = %q; want %q", got, want)
+	}
+}
+
+func TestPackNarRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	files := map[string]string{
+		"bin/hello":         "#!/bin/sh\necho hello\n",
+		"share/doc/README":  "readme",
+		"share/doc/empty":   "",
+		"lib/libfoo.so.1.0": string(bytes.Repeat([]byte{0xff}, narBufferSize+13)),
+	}
+	for name, content := range files {
+		p := filepath.Join(src, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(filepath.Join(src, "bin/hello"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hello", filepath.Join(src, "bin/hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	nar, err := io.ReadAll(PackNar(src))
+	if err != nil {
+		t.Fatalf("PackNar: %v", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "dest")
+	if err := UnpackNar(bytes.NewReader(nar), "none", dest); err != nil {
+		t.Fatalf("UnpackNar: %v", err)
+	}
+
+	repacked, err := io.ReadAll(PackNar(dest))
+	if err != nil {
+		t.Fatalf("PackNar(dest): %v", err)
+	}
+	if !bytes.Equal(nar, repacked) {
+		t.Errorf("repacked NAR differs from original (%d vs %d bytes)", len(repacked), len(nar))
+	}
+
+	hash, size, err := HashPath(src)
+	if err != nil {
+		t.Fatalf("HashPath: %v", err)
+	}
+	sum := sha256.Sum256(nar)
+	if want := "sha256:" + EncodeNixBase32(sum[:]); hash != want {
+		t.Errorf("HashPath = %q; want %q", hash, want)
+	}
+	if size != int64(len(nar)) {
+		t.Errorf("HashPath size = %d; want %d", size, len(nar))
+	}
+}
+
+func TestHashPathKnownVector(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "README"), []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin/hello"), []byte("#!/bin/sh\necho hello\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("README", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The NAR hash `nix hash path --base32` reports for this tree, computed
+	// by an encoder written from the NAR format independently of this one.
+	const want = "sha256:03p5gz7zbdya6wcvy7m31i0xaf75i3pryz73dk1fijk3gkfkb122"
+	hash, size, err := HashPath(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != want || size != 888 {
+		t.Errorf("HashPath = %q, %d; want %q, 888", hash, size, want)
+	}
+}
+
+func TestPackNarClose(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "big"), bytes.Repeat([]byte("x"), 4*narBufferSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := PackNar(src)
+	if _, err := r.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 16)); err != io.ErrClosedPipe {
+		t.Errorf("Read after Close = %v; want io.ErrClosedPipe", err)
+	}
+}
+
+func TestUnpackNarVerifiesHash(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(src, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hash, size, err := HashPath(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nar, err := io.ReadAll(PackNar(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := UnpackOptions{NarHash: hash, NarSize: size}
+	if err := UnpackNarWithOptions(bytes.NewReader(nar), "none", filepath.Join(t.TempDir(), "ok"), opts); err != nil {
+		t.Errorf("UnpackNarWithOptions with matching hash: %v", err)
+	}
+
+	opts.NarSize = size + 8
+	err = UnpackNarWithOptions(bytes.NewReader(nar), "none", filepath.Join(t.TempDir(), "size"), opts)
+	if _, ok := err.(*HashMismatchError); !ok {
+		t.Errorf("UnpackNarWithOptions with wrong size = %v; want *HashMismatchError", err)
+	}
+
+	other := sha256.Sum256([]byte("other"))
+	opts = UnpackOptions{NarHash: "sha256:" + EncodeNixBase32(other[:])}
+	err = UnpackNarWithOptions(bytes.NewReader(nar), "none", filepath.Join(t.TempDir(), "hash"), opts)
+	if _, ok := err.(*HashMismatchError); !ok {
+		t.Errorf("UnpackNarWithOptions with wrong hash = %v; want *HashMismatchError", err)
+	}
+}
+
+func TestUnpackNarRejectsNonCanonical(t *testing.T) {
+	nar := func(tokens ...string) []byte {
+		var buf bytes.Buffer
+		nw := &narWriter{w: &buf}
+		if err := nw.writeStrings(append([]string{"nix-archive-1"}, tokens...)...); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	entry := func(name string, node ...string) []string {
+		return append(append([]string{"entry", "(", "name", name, "node"}, node...), ")")
+	}
+	file := []string{"(", "type", "regular", "contents", "x", ")"}
+	dir := func(entries ...[]string) []string {
+		tokens := []string{"(", "type", "directory"}
+		for _, e := range entries {
+			tokens = append(tokens, e...)
+		}
+		return append(tokens, ")")
+	}
+
+	valid := nar(dir(entry("a", file...), entry("b", file...))...)
+	if err := UnpackNar(bytes.NewReader(valid), "none", filepath.Join(t.TempDir(), "ok")); err != nil {
+		t.Fatalf("UnpackNar(valid) = %v", err)
+	}
+
+	// The last byte of padding after the one-byte contents "x".
+	padded := nar(file...)
+	padded[len(padded)-17] = 1
+
+	tests := map[string][]byte{
+		"parent name":        nar(dir(entry("..", file...))...),
+		"slash in name":      nar(dir(entry("../../escape", file...))...),
+		"empty name":         nar(dir(entry("", file...))...),
+		"duplicate":          nar(dir(entry("a", file...), entry("a", file...))...),
+		"unsorted":           nar(dir(entry("b", file...), entry("a", file...))...),
+		"unknown file field": nar("(", "type", "regular", "mode", "x", ")"),
+		"executable value":   nar("(", "type", "regular", "executable", "yes", "contents", "x", ")"),
+		"late executable":    nar("(", "type", "regular", "contents", "x", "executable", "", ")"),
+		"missing type":       nar("(", "regular", ")"),
+		"bad entry":          nar("(", "type", "directory", "entry", "[", "name", "a", "node", "(", "type", "regular", ")", ")", ")"),
+		"symlink field":      nar("(", "type", "symlink", "link", "a", ")"),
+		"empty target":       nar("(", "type", "symlink", "target", "", ")"),
+		"trailing data":      append(valid, nar()...),
+		"truncated":          valid[:len(valid)-8],
+		"non-zero padding":   padded,
+	}
+	for name, data := range tests {
+		dest := filepath.Join(t.TempDir(), "out")
+		if err := UnpackNar(bytes.NewReader(data), "none", dest); err == nil {
+			t.Errorf("%s: UnpackNar accepted a non-canonical NAR", name)
+		}
+		if _, err := os.Lstat(filepath.Join(filepath.Dir(filepath.Dir(dest)), "escape")); err == nil {
+			t.Errorf("%s: UnpackNar wrote outside its destination", name)
+		}
+	}
+}
+
+func TestUnpackTarXzContainment(t *testing.T) {
+	tarXz := func(headers ...*tar.Header) []byte {
+		var buf bytes.Buffer
+		xw, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tw := tar.NewWriter(xw)
+		for _, h := range headers {
+			if h.Typeflag == tar.TypeReg {
+				h.Size = 1
+			}
+			if err := tw.WriteHeader(h); err != nil {
+				t.Fatal(err)
+			}
+			if h.Typeflag == tar.TypeReg {
+				tw.Write([]byte("x"))
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := xw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	dir := func(name string) *tar.Header { return &tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755} }
+	file := func(name string) *tar.Header { return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644} }
+	symlink := func(name, target string) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}
+	}
+
+	dest := filepath.Join(t.TempDir(), "ok")
+	valid := tarXz(dir("./"), dir("pkg/"), file("pkg/bin"), symlink("pkg/lib", "bin"), symlink("top", "pkg/bin"), symlink("pkg/up", "../top"),
+		&tar.Header{Name: "pkg/hard", Typeflag: tar.TypeLink, Linkname: "pkg/bin"})
+	if err := UnpackTarXz(bytes.NewReader(valid), dest); err != nil {
+		t.Fatalf("UnpackTarXz(valid) = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "pkg/hard")); err != nil || string(data) != "x" {
+		t.Errorf("hard link = %q, %v", data, err)
+	}
+
+	tests := map[string][]byte{
+		"parent name":       tarXz(file("../escape")),
+		"absolute name":     tarXz(file("/tmp/escape")),
+		"absolute symlink":  tarXz(symlink("link", "/etc")),
+		"escaping symlink":  tarXz(symlink("pkg/link", "../../escape")),
+		"through symlink":   tarXz(dir("pkg/"), symlink("pkg/link", ".."), file("pkg/link/x")),
+		"symlink chain":     tarXz(dir("a/"), symlink("a/up", ".."), symlink("a/out", "up/..")),
+		"escaping hardlink": tarXz(&tar.Header{Name: "hard", Typeflag: tar.TypeLink, Linkname: "../escape"}),
+	}
+	for name, data := range tests {
+		if err := UnpackTarXz(bytes.NewReader(data), filepath.Join(t.TempDir(), "out")); err == nil {
+			t.Errorf("%s: UnpackTarXz accepted an entry outside the archive", name)
+		}
+	}
+}
+
+func TestUnpackNarRecordsSymlinks(t *testing.T) {
+	var buf bytes.Buffer
+	nw := &narWriter{w: &buf}
+	err := nw.writeStrings("nix-archive-1", "(", "type", "directory",
+		// "a" points at a file that is only extracted after it.
+		"entry", "(", "name", "a", "node", "(", "type", "symlink", "target", "bin/hello", ")", ")",
+		"entry", "(", "name", "bin", "node", "(", "type", "directory",
+		"entry", "(", "name", "hello", "node", "(", "type", "regular", "contents", "hi", ")", ")",
+		"entry", "(", "name", "sh", "node", "(", "type", "symlink", "target", "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-bash-5.2p37/bin/sh", ")", ")",
+		")", ")",
+		"entry", "(", "name", "dangling", "node", "(", "type", "symlink", "target", "missing", ")", ")",
+		")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nar := buf.Bytes()
+
+	dest := filepath.Join(t.TempDir(), "out")
+	if err := UnpackNar(bytes.NewReader(nar), "none", dest); err != nil {
+		t.Fatalf("UnpackNar: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dest, "a")); err != nil || target != "bin/hello" {
+		t.Errorf("a -> %q, %v; want bin/hello", target, err)
+	}
+	links, err := ReadSymlinkManifest(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"bin/sh":   "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-bash-5.2p37/bin/sh",
+		"dangling": "missing",
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("symlink manifest = %v; want %v", links, want)
+	}
+
+	repacked, err := io.ReadAll(PackNar(dest))
+	if err != nil {
+		t.Fatalf("PackNar: %v", err)
+	}
+	if !bytes.Equal(nar, repacked) {
+		t.Errorf("repacked NAR differs from original (%d vs %d bytes)", len(repacked), len(nar))
+	}
+}
+
+func TestListPathAppliesSymlinkManifest(t *testing.T) {
+	const sh = "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-bash-5.2p37/bin/sh"
+	dir := filepath.Join(t.TempDir(), "dir")
+	for _, d := range []string{"bin", "share/doc"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "bin", "hello"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "share", "doc", "README"), []byte("hi\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range map[string]string{"bin/hi": "hello", "bin/sh": sh, "dangling": "missing"} {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root := filepath.Join(t.TempDir(), "root")
+	if err := os.Symlink(sh, root); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, src := range []string{dir, root} {
+		want, err := ListPath(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := PackNar(src)
+		dest := filepath.Join(t.TempDir(), "out")
+		err = UnpackNar(r, "none", dest)
+		r.Close()
+		if err != nil {
+			t.Fatalf("UnpackNar: %v", err)
+		}
+		if _, err := os.Stat(filepath.Join(dest, SymlinkManifestName)); err != nil {
+			t.Fatalf("%s: unpacking recorded no symlinks: %v", src, err)
+		}
+		got, err := ListPath(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(want)
+			t.Errorf("%s: listing after unpacking = %s; want %s", src, gotJSON, wantJSON)
+		}
+	}
+
+	listing, err := ListPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := listing.Executables("bin"), []string{"hello", "hi", "sh"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Executables(bin) = %v; want %v", got, want)
+	}
+}
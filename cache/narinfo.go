@@ -1,9 +1,7 @@
 package cache
 
 import (
-	"encoding/hex"
 	"fmt"
-	"math/big"
 	"strings"
 )
 
@@ -11,7 +9,7 @@ import (
 type NarInfo struct {
 	StorePath   string   // Full store path (e.g., /nix/store/abc-hello-2.12)
 	URL         string   // NAR file URL (relative to cache root)
-	Compression string   // Compression type (xz, zstd, etc.)
+	Compression string   // Compression type (xz, zstd, etc.; bzip2 if absent)
 	FileHash    string   // Hash of the compressed NAR file
 	FileSize    int64    // Size of the compressed NAR file
 	NarHash     string   // Hash of the uncompressed NAR
@@ -19,6 +17,11 @@ type NarInfo struct {
 	References  []string // Store paths this derivation references
 	Deriver     string   // Path to the .drv that built this
 	Sig         []string // Signatures
+
+	// CacheURL and Mirrors are not part of the .narinfo file; Cache sets
+	// them to the substituter that served it.
+	CacheURL string
+	Mirrors  []string
 }
 
 // ParseNarInfo parses a .narinfo file content.
@@ -69,12 +72,51 @@ func ParseNarInfo(content string) (*NarInfo, error) {
 	if info.StorePath == "" || info.URL == "" {
 		return nil, fmt.Errorf("invalid narinfo: missing required fields")
 	}
+	// Both hashes end up in the lockfile, so they must be usable there.
+	for _, field := range []struct{ name, value string }{
+		{"FileHash", info.FileHash},
+		{"NarHash", info.NarHash},
+	} {
+		if field.value == "" {
+			continue
+		}
+		if _, err := ParseHash(field.value); err != nil {
+			return nil, fmt.Errorf("invalid narinfo for %s: %s: %w", info.StorePath, field.name, err)
+		}
+	}
+	if info.Compression == "" {
+		info.Compression = DefaultCompression
+	}
 
 	return info, nil
 }
 
+// String formats info as .narinfo file content, in the field order Nix
+// writes. CacheURL and Mirrors are not included.
+func (info *NarInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "StorePath: %s\n", info.StorePath)
+	fmt.Fprintf(&b, "URL: %s\n", info.URL)
+	fmt.Fprintf(&b, "Compression: %s\n", info.Compression)
+	if info.FileHash != "" {
+		fmt.Fprintf(&b, "FileHash: %s\n", info.FileHash)
+		fmt.Fprintf(&b, "FileSize: %d\n", info.FileSize)
+	}
+	fmt.Fprintf(&b, "NarHash: %s\n", info.NarHash)
+	fmt.Fprintf(&b, "NarSize: %d\n", info.NarSize)
+	fmt.Fprintf(&b, "References: %s\n", strings.Join(info.References, " "))
+	if info.Deriver != "" {
+		fmt.Fprintf(&b, "Deriver: %s\n", info.Deriver)
+	}
+	for _, sig := range info.Sig {
+		fmt.Fprintf(&b, "Sig: %s\n", sig)
+	}
+	return b.String()
+}
+
 // StoreHash extracts the hash portion from a store path.
 // E.g., "/nix/store/abc123-hello-2.12" -> "abc123"
+// It does not validate its input; use ParseStorePath for that.
 func StoreHash(storePath string) string {
 	// Remove /nix/store/ prefix
 	path := strings.TrimPrefix(storePath, "/nix/store/")
@@ -85,6 +127,15 @@ func StoreHash(storePath string) string {
 	return path
 }
 
+// StoreBaseName returns the final component of a store path,
+// e.g. "/nix/store/abc123-hello-2.12" -> "abc123-hello-2.12".
+func StoreBaseName(storePath string) string {
+	if idx := strings.LastIndex(storePath, "/"); idx >= 0 {
+		return storePath[idx+1:]
+	}
+	return storePath
+}
+
 // StoreName extracts the name portion from a store path.
 // E.g., "/nix/store/abc123-hello-2.12" -> "hello-2.12"
 func StoreName(storePath string) string {
@@ -94,41 +145,3 @@ func StoreName(storePath string) string {
 	}
 	return path
 }
-
-// NixHashToHex converts a Nix-style Base32 hash to a standard Hex string.
-func NixHashToHex(h string) (string, error) {
-	if strings.HasPrefix(h, "sha256:") {
-		h = h[7:]
-	}
-	const alphabet = "0123456789abcdfghijklmnpqrsvwxyz"
-
-	n := new(big.Int)
-	base := big.NewInt(32)
-
-	for i := 0; i < len(h); i++ {
-		char := h[i]
-		val := strings.IndexByte(alphabet, char)
-		if val == -1 {
-			return "", fmt.Errorf("invalid character %c", char)
-		}
-		n.Mul(n, base)
-		n.Add(n, big.NewInt(int64(val)))
-	}
-
-	bytes := n.Bytes()
-	// Pad to 32 bytes (SHA256)
-	if len(bytes) < 32 {
-		padding := make([]byte, 32-len(bytes))
-		bytes = append(padding, bytes...)
-	} else if len(bytes) > 32 {
-		// Should not happen for sha256 unless hash is wrong type
-		// but big.Int might have leading zero byte if interpreted signed? Unlikely for SetBytes relative.
-	}
-
-	// Nix uses little-endian for the number, so we reverse the bytes for standard Hex (Big Endian display)
-	for i, j := 0, len(bytes)-1; i < j; i, j = i+1, j-1 {
-		bytes[i], bytes[j] = bytes[j], bytes[i]
-	}
-
-	return hex.EncodeToString(bytes), nil
-}
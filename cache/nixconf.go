@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxIncludeDepth bounds nested nix.conf includes.
+const maxIncludeDepth = 16
+
+// NixConf holds the nix.conf settings relevant to querying binary caches.
+type NixConf struct {
+	Substituters      []string
+	TrustedPublicKeys []string
+	NetrcFile         string
+	// AccessTokens maps a host, or host/path prefix, to a token.
+	AccessTokens map[string]string
+
+	// settings holds every recognised setting as it is parsed, so later
+	// files override earlier ones and extra-<name> appends.
+	settings map[string][]string
+}
+
+// nixConfSettings are the settings NixConf tracks.
+var nixConfSettings = map[string]bool{
+	"substituters":        true,
+	"trusted-public-keys": true,
+	"netrc-file":          true,
+	"access-tokens":       true,
+}
+
+// nixConfDir returns $NIX_CONF_DIR, or /etc/nix.
+func nixConfDir() string {
+	if dir := os.Getenv("NIX_CONF_DIR"); dir != "" {
+		return dir
+	}
+	return "/etc/nix"
+}
+
+// NixConfFiles returns the nix.conf files Nix reads, lowest precedence
+// first: the system file, then the user files from $NIX_USER_CONF_FILES or
+// the XDG config directories.
+func NixConfFiles() []string {
+	files := []string{filepath.Join(nixConfDir(), "nix.conf")}
+
+	if env := os.Getenv("NIX_USER_CONF_FILES"); env != "" {
+		// The first entry has the highest precedence.
+		user := filepath.SplitList(env)
+		for i := len(user) - 1; i >= 0; i-- {
+			files = append(files, user[i])
+		}
+		return files
+	}
+
+	dirs := filepath.SplitList(os.Getenv("XDG_CONFIG_DIRS"))
+	if len(dirs) == 0 {
+		dirs = []string{"/etc/xdg"}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		files = append(files, filepath.Join(dirs[i], "nix", "nix.conf"))
+	}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		files = append(files, filepath.Join(configHome, "nix", "nix.conf"))
+	}
+	return files
+}
+
+// LoadNixConf reads the user's Nix configuration the way Nix does: every
+// file from NixConfFiles that exists, then the contents of $NIX_CONFIG.
+// Settings not given anywhere keep Nix's defaults.
+func LoadNixConf() (*NixConf, error) {
+	nc := newNixConf()
+	for _, path := range NixConfFiles() {
+		if err := nc.parseFile(path, false, 0); err != nil {
+			return nil, err
+		}
+	}
+	if env := os.Getenv("NIX_CONFIG"); env != "" {
+		if err := nc.parse(env, "NIX_CONFIG", "", 0); err != nil {
+			return nil, err
+		}
+	}
+	nc.finish()
+	return nc, nil
+}
+
+// ParseNixConf parses nix.conf content on top of Nix's defaults. Relative
+// includes are resolved against dir.
+func ParseNixConf(content, dir string) (*NixConf, error) {
+	nc := newNixConf()
+	if err := nc.parse(content, "nix.conf", dir, 0); err != nil {
+		return nil, err
+	}
+	nc.finish()
+	return nc, nil
+}
+
+func newNixConf() *NixConf {
+	return &NixConf{settings: map[string][]string{
+		"substituters":        {DefaultCacheURL + "/"},
+		"trusted-public-keys": DefaultTrustedPublicKeys,
+		"netrc-file":          {filepath.Join(nixConfDir(), "netrc")},
+	}}
+}
+
+func (nc *NixConf) parseFile(path string, required bool, depth int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return nil
+		}
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nc.parse(string(data), path, filepath.Dir(path), depth)
+}
+
+// parse applies one nix.conf. name is used in error messages.
+func (nc *NixConf) parse(content, name, dir string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: includes nested too deeply", name)
+	}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] == "include" || fields[0] == "!include" {
+			if len(fields) != 2 {
+				return fmt.Errorf("%s:%d: syntax error in include", name, lineNo)
+			}
+			path := fields[1]
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			if err := nc.parseFile(path, fields[0] == "include", depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(fields) < 2 || fields[1] != "=" {
+			return fmt.Errorf("%s:%d: expected 'name = value'", name, lineNo)
+		}
+		key, values := fields[0], fields[2:]
+		if base, ok := strings.CutPrefix(key, "extra-"); ok && nixConfSettings[base] {
+			nc.settings[base] = append(append([]string(nil), nc.settings[base]...), values...)
+		} else if nixConfSettings[key] {
+			nc.settings[key] = values
+		}
+	}
+	return scanner.Err()
+}
+
+// finish copies the parsed settings into the exported fields.
+func (nc *NixConf) finish() {
+	nc.Substituters = nc.settings["substituters"]
+	nc.TrustedPublicKeys = nc.settings["trusted-public-keys"]
+	if netrc := nc.settings["netrc-file"]; len(netrc) > 0 {
+		nc.NetrcFile = netrc[0]
+	}
+	nc.AccessTokens = make(map[string]string)
+	for _, t := range nc.settings["access-tokens"] {
+		if host, token, ok := strings.Cut(t, "="); ok {
+			nc.AccessTokens[host] = token
+		}
+	}
+}
+
+// Credentials returns the credentials from the netrc file and access
+// tokens. A missing netrc file is not an error.
+func (nc *NixConf) Credentials() (*Credentials, error) {
+	creds := &Credentials{AccessTokens: nc.AccessTokens}
+	if nc.NetrcFile == "" {
+		return creds, nil
+	}
+	data, err := os.ReadFile(nc.NetrcFile)
+	if os.IsNotExist(err) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read netrc: %w", err)
+	}
+	creds.Netrc = ParseNetrc(string(data))
+	return creds, nil
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseNixConf(t *testing.T) {
+	dir := t.TempDir()
+	extra := "extra-substituters = https://extra.example\n!include missing.conf\n"
+	if err := os.WriteFile(filepath.Join(dir, "extra.conf"), []byte(extra), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := ParseNixConf(`
+# comment
+substituters = https://a.example https://b.example/ # trailing comment
+include extra.conf
+trusted-public-keys = a-1:AAAA
+extra-trusted-public-keys = b-1:BBBB
+netrc-file = /run/secrets/netrc
+access-tokens = github.com=ghp_x cache.example/private=tok
+unrelated-setting = 1
+`, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"https://a.example", "https://b.example/", "https://extra.example"}; !reflect.DeepEqual(conf.Substituters, want) {
+		t.Errorf("Substituters = %v; want %v", conf.Substituters, want)
+	}
+	if want := []string{"a-1:AAAA", "b-1:BBBB"}; !reflect.DeepEqual(conf.TrustedPublicKeys, want) {
+		t.Errorf("TrustedPublicKeys = %v; want %v", conf.TrustedPublicKeys, want)
+	}
+	if conf.NetrcFile != "/run/secrets/netrc" {
+		t.Errorf("NetrcFile = %q", conf.NetrcFile)
+	}
+	if want := map[string]string{"github.com": "ghp_x", "cache.example/private": "tok"}; !reflect.DeepEqual(conf.AccessTokens, want) {
+		t.Errorf("AccessTokens = %v; want %v", conf.AccessTokens, want)
+	}
+
+	// extra- settings append to the defaults when nothing overrides them.
+	conf, err = ParseNixConf("extra-substituters = https://extra.example", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{DefaultCacheURL + "/", "https://extra.example"}; !reflect.DeepEqual(conf.Substituters, want) {
+		t.Errorf("Substituters = %v; want %v", conf.Substituters, want)
+	}
+
+	if _, err := ParseNixConf("include missing.conf", dir); err == nil {
+		t.Error("include of a missing file succeeded")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "ci" || pass != "s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/"+testHash+".narinfo" {
+			fmt.Fprintf(w, "StorePath: /nix/store/%s-hello\nURL: nar/x.nar\n", testHash)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	if _, err := c.LookupNarInfo(testHash); err == nil {
+		t.Fatal("unauthenticated lookup succeeded")
+	}
+
+	netrc := ParseNetrc(`
+machine other.example login x password y
+macdef init
+  cd /pub
+
+machine 127.0.0.1
+  login ci
+  password s3cret
+default login anonymous password guest
+`)
+	if len(netrc) != 3 || netrc[1].Login != "ci" || netrc[2].Machine != "" {
+		t.Fatalf("ParseNetrc = %+v", netrc)
+	}
+	c = New(srv.URL)
+	c.Credentials = &Credentials{Netrc: netrc}
+	if info, err := c.LookupNarInfo(testHash); err != nil || info == nil {
+		t.Fatalf("authenticated lookup = %v, %v", info, err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "https://cache.example/private/x.narinfo", nil)
+	(&Credentials{AccessTokens: map[string]string{"cache.example": "a", "cache.example/private": "b"}}).authorize(req)
+	if got := req.Header.Get("Authorization"); got != "Bearer b" {
+		t.Errorf("Authorization = %q; want the most specific token", got)
+	}
+}
@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// PackNar serializes the file, directory or symlink at path as a NAR.
+// The archive is produced lazily as the returned reader is consumed; any
+// filesystem error surfaces from Read. Callers that stop reading early must
+// Close the reader, or the goroutine producing the archive never exits.
+//
+// The encoding is canonical, matching `nix-store --dump`: directory entries
+// are sorted by name, only the owner-executable bit is recorded, and
+// symlinks are stored verbatim without being followed.
+func PackNar(path string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(WriteNar(pw, path))
+	}()
+	return pr
+}
+
+// WriteNar writes the NAR serialization of path to w. If path has a
+// symlink manifest (see SymlinkManifestName), the symlinks it records are
+// serialized in place and the manifest itself is left out.
+func WriteNar(w io.Writer, path string) error {
+	tree, err := newSymlinkTree(path)
+	if err != nil {
+		return err
+	}
+	nw := &narWriter{w: w, buf: make([]byte, narBufferSize), tree: tree}
+	if err := nw.writeString("nix-archive-1"); err != nil {
+		return err
+	}
+	return nw.writeEntry(path)
+}
+
+// HashPath computes the NAR hash of path the way `nix hash path --base32`
+// does, returning it in the "sha256:<base32>" form used by NarHash fields,
+// along with the size of the serialized NAR.
+func HashPath(path string) (string, int64, error) {
+	h, size, err := HashPathWithAlgorithm(path, "sha256")
+	if err != nil {
+		return "", 0, err
+	}
+	return h.String(), size, nil
+}
+
+// HashPathWithAlgorithm computes the NAR hash of path with any supported
+// algorithm, as for a derivation output with outputHashMode = "recursive".
+func HashPathWithAlgorithm(path, algorithm string) (Hash, int64, error) {
+	hasher, err := NewHasher(algorithm)
+	if err != nil {
+		return Hash{}, 0, err
+	}
+	cw := &countingWriter{w: hasher}
+	if err := WriteNar(cw, path); err != nil {
+		return Hash{}, 0, err
+	}
+	return Hash{Algorithm: algorithm, Digest: hasher.Sum(nil)}, cw.n, nil
+}
+
+// narWriter emits NAR tokens to an underlying writer.
+type narWriter struct {
+	w   io.Writer
+	buf []byte
+
+	// tree is the path being serialized.
+	tree symlinkTree
+}
+
+func (nw *narWriter) writeLength(length uint64) error {
+	var lenBuf [8]byte
+	binary.LittleEndian.PutUint64(lenBuf[:], length)
+	_, err := nw.w.Write(lenBuf[:])
+	return err
+}
+
+func (nw *narWriter) writePadding(length uint64) error {
+	padLen := (8 - (length % 8)) % 8
+	if padLen == 0 {
+		return nil
+	}
+	var pad [8]byte
+	_, err := nw.w.Write(pad[:padLen])
+	return err
+}
+
+func (nw *narWriter) writeString(s string) error {
+	if err := nw.writeLength(uint64(len(s))); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(nw.w, s); err != nil {
+		return err
+	}
+	return nw.writePadding(uint64(len(s)))
+}
+
+func (nw *narWriter) writeStrings(tokens ...string) error {
+	for _, t := range tokens {
+		if err := nw.writeString(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (nw *narWriter) writeEntry(path string) error {
+	if err := nw.writeStrings("(", "type"); err != nil {
+		return err
+	}
+	if target, ok := nw.tree.symlink(path); ok {
+		if err := nw.writeStrings("symlink", "target", target); err != nil {
+			return err
+		}
+		return nw.writeString(")")
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		if err := nw.writeString("regular"); err != nil {
+			return err
+		}
+		if mode&0100 != 0 {
+			if err := nw.writeStrings("executable", ""); err != nil {
+				return err
+			}
+		}
+		if err := nw.writeString("contents"); err != nil {
+			return err
+		}
+		if err := nw.writeContents(path, info.Size()); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err := nw.writeStrings("symlink", "target", target); err != nil {
+			return err
+		}
+	case mode.IsDir():
+		if err := nw.writeString("directory"); err != nil {
+			return err
+		}
+		names, err := nw.tree.readDir(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := nw.writeStrings("entry", "(", "name", name, "node"); err != nil {
+				return err
+			}
+			if err := nw.writeEntry(filepath.Join(path, name)); err != nil {
+				return err
+			}
+			if err := nw.writeString(")"); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cannot serialize %s: unsupported file type %s", path, mode.Type())
+	}
+
+	return nw.writeString(")")
+}
+
+// writeContents streams a regular file as a NAR string.
+func (nw *narWriter) writeContents(path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := nw.writeLength(uint64(size)); err != nil {
+		return err
+	}
+	n, err := io.CopyBuffer(nw.w, io.LimitReader(f, size), nw.buf)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("%s changed size while being serialized", path)
+	}
+	return nw.writePadding(uint64(size))
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,138 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// DefaultPublishCompression is the compression Publish uses when none is
+// given, matching `nix copy --to file://`.
+const DefaultPublishCompression = "xz"
+
+// PublishOptions controls how Publish writes a store path into a binary
+// cache directory.
+type PublishOptions struct {
+	// Compression is the NAR compression; see NewCompressor.
+	Compression string
+	// SecretKey, if set, signs the narinfo.
+	SecretKey *SecretKey
+	// ReferenceCandidates are the store paths the output may refer to,
+	// typically the input closure of the derivation that built it. If
+	// empty, every store path mentioned in the output is recorded.
+	ReferenceCandidates []string
+	// Deriver is the .drv that built the output, if known.
+	Deriver string
+}
+
+// Publish packs src as the contents of storePath and writes it into the
+// binary cache directory cacheDir, in the layout `nix copy --to file://`
+// produces: <hash>.narinfo and a <hash>.ls listing at the root, and the
+// compressed NAR under nar/.
+// The directory is created, along with a nix-cache-info, if needed.
+func Publish(cacheDir, storePath, src string, opts PublishOptions) (*NarInfo, error) {
+	if _, err := ParseStorePath(storePath); err != nil {
+		return nil, err
+	}
+	compression := opts.Compression
+	if compression == "" {
+		compression = DefaultPublishCompression
+	}
+
+	narDir := filepath.Join(cacheDir, "nar")
+	if err := os.MkdirAll(narDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeCacheInfo(cacheDir); err != nil {
+		return nil, err
+	}
+
+	candidates := opts.ReferenceCandidates
+	if len(candidates) > 0 {
+		// Outputs may always refer to themselves.
+		candidates = append([]string{storePath}, candidates...)
+	}
+	scanner := NewReferenceScanner(candidates)
+
+	tmp, err := os.CreateTemp(narDir, ".tmp-*.nar")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	fileHasher := sha256.New()
+	file := &countingWriter{w: io.MultiWriter(tmp, fileHasher)}
+	compressor, err := NewCompressor(file, compression)
+	if err != nil {
+		return nil, err
+	}
+	narHasher := sha256.New()
+	nar := &countingWriter{w: io.MultiWriter(compressor, narHasher, scanner)}
+	if err := WriteNar(nar, src); err != nil {
+		return nil, fmt.Errorf("failed to pack %s: %w", src, err)
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress NAR: %w", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	fileHash := Hash{Algorithm: "sha256", Digest: fileHasher.Sum(nil)}
+	info := &NarInfo{
+		StorePath:   storePath,
+		URL:         "nar/" + fileHash.Base32() + ".nar" + CompressionExtension(compression),
+		Compression: compression,
+		FileHash:    fileHash.String(),
+		FileSize:    file.n,
+		NarHash:     Hash{Algorithm: "sha256", Digest: narHasher.Sum(nil)}.String(),
+		NarSize:     nar.n,
+		References:  scanner.References(),
+	}
+	if opts.Deriver != "" {
+		info.Deriver = StoreBaseName(opts.Deriver)
+	}
+	if opts.SecretKey != nil {
+		info.Sig = []string{opts.SecretKey.Sign(info)}
+	}
+
+	listing, err := ListPath(src)
+	if err != nil {
+		return nil, err
+	}
+	listingJSON, err := json.Marshal(listing)
+	if err != nil {
+		return nil, err
+	}
+
+	// The NAR and listing go in first so the narinfo never points at a
+	// missing file.
+	if err := os.Rename(tmp.Name(), filepath.Join(cacheDir, info.URL)); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(filepath.Join(cacheDir, StoreHash(storePath)+".ls"), listingJSON); err != nil {
+		return nil, err
+	}
+	narInfoPath := filepath.Join(cacheDir, StoreHash(storePath)+".narinfo")
+	if err := writeFileAtomic(narInfoPath, []byte(info.String())); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// writeCacheInfo creates <cacheDir>/nix-cache-info unless it exists.
+func writeCacheInfo(cacheDir string) error {
+	path := filepath.Join(cacheDir, "nix-cache-info")
+	if _, err := os.Stat(path); err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return writeFileAtomic(path, []byte("StoreDir: "+DefaultStoreDir+"\n"))
+}
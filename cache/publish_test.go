@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	testSelf = "/nix/store/0mdqa9w1p6cmli6976v4wi0sw9r4p5pr-hello-2.12"
+	testDep  = "/nix/store/1b9p07z77phvv2hf6gm9f28syp39f1ag-glibc-2.40"
+)
+
+func TestReferenceScannerAcrossWrites(t *testing.T) {
+	data := "prefix " + testDep + "/lib/libc.so.6\x00" + testSelf
+	for _, candidates := range [][]string{nil, {testSelf, testDep, "/nix/store/2fmzgbc7ck8ys6lprd6crjhy9dpdwphr-unused"}} {
+		s := NewReferenceScanner(candidates)
+		// One byte at a time, so every match spans writes.
+		for i := 0; i < len(data); i++ {
+			s.Write([]byte{data[i]})
+		}
+		want := []string{StoreBaseName(testSelf), StoreBaseName(testDep)}
+		if got := s.References(); !reflect.DeepEqual(got, want) {
+			t.Errorf("candidates %v: References() = %v; want %v", candidates, got, want)
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "out")
+	if err := os.MkdirAll(filepath.Join(src, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!" + testDep + "/bin/sh\nexec " + testSelf + "/libexec/hello\n"
+	if err := os.WriteFile(filepath.Join(src, "bin", "hello"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := SecretKey{Name: "test-1", Key: priv}
+
+	cacheDir := t.TempDir()
+	info, err := Publish(cacheDir, testSelf, src, PublishOptions{SecretKey: &key})
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(cacheDir, StoreHash(testSelf)+".narinfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseNarInfo(string(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Compression != "xz" || parsed.NarHash != info.NarHash || parsed.FileSize != info.FileSize {
+		t.Errorf("narinfo round trip mismatch:\n%s", data)
+	}
+	wantRefs := []string{StoreBaseName(testSelf), StoreBaseName(testDep)}
+	if !reflect.DeepEqual(parsed.References, wantRefs) {
+		t.Errorf("References = %v; want %v", parsed.References, wantRefs)
+	}
+
+	tk, err := ParseTrustedKeys([]string{"test-1:" + base64.StdEncoding.EncodeToString(pub)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tk.Verify(parsed); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+
+	nar, err := os.Open(filepath.Join(cacheDir, parsed.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nar.Close()
+	dest := filepath.Join(t.TempDir(), "unpacked")
+	opts := UnpackOptions{NarHash: parsed.NarHash, NarSize: parsed.NarSize}
+	if err := UnpackNarWithOptions(nar, parsed.Compression, dest, opts); err != nil {
+		t.Fatalf("unpacking published NAR: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dest, "bin", "hello")); string(got) != script {
+		t.Errorf("unpacked bin/hello = %q; want %q", got, script)
+	}
+}
+
+func TestNarListing(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "out")
+	for _, dir := range []string{"bin", "share"} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "hello"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "bin", "README"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("hello", filepath.Join(src, "bin", "hi")); err != nil {
+		t.Fatal(err)
+	}
+
+	cacheDir := t.TempDir()
+	info, err := Publish(cacheDir, testSelf, src, PublishOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The listing is served compressed, as cache.nixos.org does.
+	plain, err := os.ReadFile(filepath.Join(cacheDir, StoreHash(testSelf)+".ls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+StoreHash(testSelf)+".ls" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "br")
+		bw := brotli.NewWriter(w)
+		bw.Write(plain)
+		bw.Close()
+	}))
+	defer srv.Close()
+
+	for _, url := range []string{cacheDir, srv.URL} {
+		c := New(url)
+		info.CacheURL = c.URL
+		listing, err := c.NarListing(info)
+		if err != nil || listing == nil {
+			t.Fatalf("%s: NarListing = %v, %v", url, listing, err)
+		}
+		if got, want := listing.Executables("bin"), []string{"hello", "hi"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: Executables(bin) = %v; want %v", url, got, want)
+		}
+		if e := listing.Lookup("bin/hi"); e == nil || e.Target != "hello" {
+			t.Errorf("%s: Lookup(bin/hi) = %+v", url, e)
+		}
+		if listing.Executables("share") != nil || listing.Lookup("bin/hello/x") != nil {
+			t.Errorf("%s: unexpected entries", url)
+		}
+	}
+
+	info.StorePath = testDep
+	if listing, err := New(cacheDir).NarListing(info); err != nil || listing != nil {
+		t.Errorf("NarListing of an unlisted path = %v, %v; want nil, nil", listing, err)
+	}
+}
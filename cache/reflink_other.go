@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cache
+
+import "errors"
+
+// reflink is only implemented on Linux; elsewhere linkFile falls back to
+// plain copies.
+func reflink(src, dst string) error {
+	return errors.ErrUnsupported
+}
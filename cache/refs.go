@@ -0,0 +1,159 @@
+package cache
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+const (
+	// storeHashLen is the length of the base32 hash part of a store path.
+	storeHashLen = 32
+	// maxStoreNameLen is the longest name Nix allows after the hash part.
+	maxStoreNameLen = 211
+)
+
+// ReferenceScanner is an io.Writer that records the store paths mentioned in
+// the data written to it, the way Nix scans a build output for references.
+//
+// With candidates, only their hash parts are searched for, exactly as Nix
+// does with a derivation's input closure. Without candidates, any
+// "<storeDir>/<hash>-<name>" string is recorded instead, which finds the
+// same references as long as they appear as full paths.
+type ReferenceScanner struct {
+	storeDir   string
+	candidates map[string]string // hash part -> base name
+	found      map[string]bool   // base names
+	tail       []byte
+}
+
+// NewReferenceScanner returns a scanner for store paths under
+// DefaultStoreDir. candidates may be full store paths or base names.
+func NewReferenceScanner(candidates []string) *ReferenceScanner {
+	s := &ReferenceScanner{storeDir: DefaultStoreDir, found: make(map[string]bool)}
+	if len(candidates) > 0 {
+		s.candidates = make(map[string]string, len(candidates))
+		for _, c := range candidates {
+			base := StoreBaseName(c)
+			s.candidates[StoreHash(base)] = base
+		}
+	}
+	return s
+}
+
+// Write scans p. Matches spanning calls are found because the end of each
+// chunk is kept until the next one arrives.
+func (s *ReferenceScanner) Write(p []byte) (int, error) {
+	buf := append(s.tail, p...)
+	if s.candidates != nil {
+		s.scanHashes(buf)
+		s.tail = keepTail(buf, storeHashLen-1)
+	} else {
+		s.tail = s.scanPaths(buf, false)
+	}
+	return len(p), nil
+}
+
+// References returns the base names of the store paths found so far,
+// sorted as in a narinfo References field.
+func (s *ReferenceScanner) References() []string {
+	if s.candidates == nil && len(s.tail) > 0 {
+		// A path running up to the end of the data is complete now.
+		s.tail = s.scanPaths(s.tail, true)
+	}
+	refs := make([]string, 0, len(s.found))
+	for ref := range s.found {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// scanHashes records every candidate whose hash part occurs in buf.
+func (s *ReferenceScanner) scanHashes(buf []byte) {
+	for i := 0; i+storeHashLen <= len(buf); {
+		// Check the window right to left so an invalid byte lets us skip
+		// every window containing it.
+		j := storeHashLen - 1
+		for j >= 0 && isNixBase32(buf[i+j]) {
+			j--
+		}
+		if j >= 0 {
+			i += j + 1
+			continue
+		}
+		if base, ok := s.candidates[string(buf[i:i+storeHashLen])]; ok {
+			s.found[base] = true
+		}
+		i++
+	}
+}
+
+// scanPaths records every complete store path in buf and returns the bytes
+// that must be kept for the next chunk. At eof, a path ending with buf is
+// complete.
+func (s *ReferenceScanner) scanPaths(buf []byte, eof bool) []byte {
+	prefix := []byte(s.storeDir + "/")
+	i := 0
+	for {
+		idx := bytes.Index(buf[i:], prefix)
+		if idx < 0 {
+			return keepTail(buf, len(prefix)-1)
+		}
+		start := i + idx
+		hashStart := start + len(prefix)
+		nameStart := hashStart + storeHashLen + 1
+		if nameStart > len(buf) {
+			if eof {
+				return nil
+			}
+			return keepTail(buf, len(buf)-start)
+		}
+		i = start + 1
+		if buf[nameStart-1] != '-' || !allNixBase32(buf[hashStart:nameStart-1]) {
+			continue
+		}
+		end := nameStart
+		for end < len(buf) && end-nameStart < maxStoreNameLen && isStoreNameChar(buf[end]) {
+			end++
+		}
+		if end == len(buf) && end-nameStart < maxStoreNameLen && !eof {
+			return keepTail(buf, len(buf)-start)
+		}
+		if end > nameStart {
+			s.found[string(buf[hashStart:end])] = true
+		}
+		i = end
+	}
+}
+
+// keepTail returns a copy of the last n bytes of buf.
+func keepTail(buf []byte, n int) []byte {
+	if n > len(buf) {
+		n = len(buf)
+	}
+	return append([]byte(nil), buf[len(buf)-n:]...)
+}
+
+func isNixBase32(c byte) bool {
+	return strings.IndexByte(nixBase32Alphabet, c) >= 0
+}
+
+func allNixBase32(b []byte) bool {
+	for _, c := range b {
+		if !isNixBase32(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// isStoreNameChar reports whether c may appear in the name part of a store
+// path.
+func isStoreNameChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("+-._?=", c) >= 0
+}
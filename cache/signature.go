@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// DefaultTrustedPublicKeys are the keys trusted when none are configured,
+// matching Nix's default trusted-public-keys setting.
+var DefaultTrustedPublicKeys = []string{
+	"cache.nixos.org-1:6NCHdD59X431o0gWypbMrAURkbJ16ZPMQFGspcDShjY=",
+}
+
+// PublicKey is a named ed25519 key in Nix's "name:base64" form.
+type PublicKey struct {
+	Name string
+	Key  ed25519.PublicKey
+}
+
+// ParsePublicKey parses a key such as "cache.nixos.org-1:6NCH...".
+func ParsePublicKey(s string) (PublicKey, error) {
+	name, encoded, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || name == "" {
+		return PublicKey{}, fmt.Errorf("invalid public key %q: expected name:base64", s)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("invalid public key %q: %w", s, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return PublicKey{}, fmt.Errorf("invalid public key %q: got %d bytes, want %d", s, len(key), ed25519.PublicKeySize)
+	}
+	return PublicKey{Name: name, Key: ed25519.PublicKey(key)}, nil
+}
+
+// TrustedKeys maps key names to the public keys narinfo signatures are
+// checked against.
+type TrustedKeys map[string]ed25519.PublicKey
+
+// ParseTrustedKeys parses a list of "name:base64" public keys.
+func ParseTrustedKeys(keys []string) (TrustedKeys, error) {
+	tk := make(TrustedKeys, len(keys))
+	for _, k := range keys {
+		pk, err := ParsePublicKey(k)
+		if err != nil {
+			return nil, err
+		}
+		tk[pk.Name] = pk.Key
+	}
+	return tk, nil
+}
+
+// Fingerprint returns the string Nix signs for a narinfo:
+// "1;<storePath>;<narHash>;<narSize>;<comma-separated references>", with
+// references expanded to full store paths.
+func (info *NarInfo) Fingerprint() string {
+	storeDir := strings.TrimSuffix(info.StorePath, "/"+StoreBaseName(info.StorePath))
+	refs := make([]string, len(info.References))
+	for i, ref := range info.References {
+		if strings.HasPrefix(ref, "/") {
+			refs[i] = ref
+		} else {
+			refs[i] = storeDir + "/" + ref
+		}
+	}
+	return fmt.Sprintf("1;%s;%s;%d;%s", info.StorePath, info.NarHash, info.NarSize, strings.Join(refs, ","))
+}
+
+// Verify checks that info carries at least one valid signature from a
+// trusted key. Signatures from unknown keys are ignored.
+func (tk TrustedKeys) Verify(info *NarInfo) error {
+	if len(info.Sig) == 0 {
+		return fmt.Errorf("%s: narinfo is unsigned", info.StorePath)
+	}
+	fingerprint := []byte(info.Fingerprint())
+	var invalid error
+	for _, sig := range info.Sig {
+		name, encoded, ok := strings.Cut(sig, ":")
+		if !ok {
+			continue
+		}
+		key, trusted := tk[name]
+		if !trusted {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(raw) != ed25519.SignatureSize {
+			invalid = fmt.Errorf("%s: malformed signature from %s", info.StorePath, name)
+			continue
+		}
+		if !ed25519.Verify(key, fingerprint, raw) {
+			invalid = fmt.Errorf("%s: invalid signature from %s", info.StorePath, name)
+			continue
+		}
+		return nil
+	}
+	if invalid != nil {
+		return invalid
+	}
+	return fmt.Errorf("%s: no signature from a trusted key", info.StorePath)
+}
+
+// SecretKey is a named ed25519 signing key in Nix's "name:base64" form, as
+// produced by `nix key generate-secret`.
+type SecretKey struct {
+	Name string
+	Key  ed25519.PrivateKey
+}
+
+// ParseSecretKey parses a secret key such as "my-cache-1:base64...".
+func ParseSecretKey(s string) (SecretKey, error) {
+	name, encoded, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok || name == "" {
+		return SecretKey{}, fmt.Errorf("invalid secret key: expected name:base64")
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return SecretKey{}, fmt.Errorf("invalid secret key %s: %w", name, err)
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return SecretKey{}, fmt.Errorf("invalid secret key %s: got %d bytes, want %d", name, len(key), ed25519.PrivateKeySize)
+	}
+	return SecretKey{Name: name, Key: ed25519.PrivateKey(key)}, nil
+}
+
+// PublicKey returns the public half of sk in the form accepted by
+// ParsePublicKey.
+func (sk SecretKey) PublicKey() string {
+	pub := sk.Key.Public().(ed25519.PublicKey)
+	return sk.Name + ":" + base64.StdEncoding.EncodeToString(pub)
+}
+
+// Sign returns the "name:base64" signature of info's fingerprint.
+func (sk SecretKey) Sign(info *NarInfo) string {
+	sig := ed25519.Sign(sk.Key, []byte(info.Fingerprint()))
+	return sk.Name + ":" + base64.StdEncoding.EncodeToString(sig)
+}
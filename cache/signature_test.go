@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestFingerprint(t *testing.T) {
+	info := &NarInfo{
+		StorePath:  "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2",
+		NarHash:    "sha256:1w7k2s8bbn7jgmvj4ih6ra0z45g5lz8x0qdyqv9gsb8p3iqhxr4w",
+		NarSize:    274328,
+		References: []string{"i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2", "j193mfi0f921y0kfs8vjc1znnr45ispv-glibc-2.40-66"},
+	}
+	want := "1;/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2;" +
+		"sha256:1w7k2s8bbn7jgmvj4ih6ra0z45g5lz8x0qdyqv9gsb8p3iqhxr4w;274328;" +
+		"/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2,/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-glibc-2.40-66"
+	if got := info.Fingerprint(); got != want {
+		t.Errorf("Fingerprint() = %q; want %q", got, want)
+	}
+}
+
+func TestTrustedKeysVerify(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ParseTrustedKeys([]string{"test-1:" + base64.StdEncoding.EncodeToString(pub)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &NarInfo{
+		StorePath: "/nix/store/y444cql8qq65srq29i2jlrgq26amb227-simple-drv",
+		NarHash:   "sha256:0mdqa9w1p6cmli6976v4wi0sw9r4p5prkj7lzfd1877wk11c9c73",
+		NarSize:   120,
+	}
+	sig := base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(info.Fingerprint())))
+
+	tests := []struct {
+		name    string
+		sigs    []string
+		wantErr string
+	}{
+		{"valid", []string{"test-1:" + sig}, ""},
+		{"valid after unknown key", []string{"other-1:" + sig, "test-1:" + sig}, ""},
+		{"unsigned", nil, "unsigned"},
+		{"untrusted", []string{"other-1:" + sig}, "no signature from a trusted key"},
+		{"tampered", []string{"test-1:" + base64.StdEncoding.EncodeToString(make([]byte, ed25519.SignatureSize))}, "invalid signature"},
+		{"malformed", []string{"test-1:!!"}, "malformed signature"},
+	}
+	for _, tt := range tests {
+		info.Sig = tt.sigs
+		err := keys.Verify(info)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: Verify() = %v; want nil", tt.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Verify() = %v; want error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// StorePath is a validated Nix store path in DefaultStoreDir.
+type StorePath struct {
+	Hash string // 32 characters of Nix base32
+	Name string
+}
+
+// ParseStorePath parses a full store path such as
+// "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2". Paths inside a
+// store path are rejected; use the store path itself.
+func ParseStorePath(path string) (StorePath, error) {
+	base, ok := strings.CutPrefix(path, DefaultStoreDir+"/")
+	if !ok {
+		return StorePath{}, fmt.Errorf("invalid store path %q: not in %s", path, DefaultStoreDir)
+	}
+	return ParseStorePathBase(base)
+}
+
+// ParseStorePathBase parses the base name of a store path, as found in
+// narinfo References.
+func ParseStorePathBase(base string) (StorePath, error) {
+	if len(base) < storeHashLen+2 || base[storeHashLen] != '-' {
+		return StorePath{}, fmt.Errorf("invalid store path %q: expected <hash>-<name>", base)
+	}
+	p := StorePath{Hash: base[:storeHashLen], Name: base[storeHashLen+1:]}
+	if !allNixBase32([]byte(p.Hash)) {
+		return StorePath{}, fmt.Errorf("invalid store path %q: hash is not Nix base32", base)
+	}
+	if err := checkStoreName(p.Name); err != nil {
+		return StorePath{}, fmt.Errorf("invalid store path %q: %w", base, err)
+	}
+	return p, nil
+}
+
+// checkStoreName applies Nix's rules for the name part of a store path.
+func checkStoreName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if len(name) > maxStoreNameLen {
+		return fmt.Errorf("name longer than %d characters", maxStoreNameLen)
+	}
+	if name[0] == '.' {
+		return fmt.Errorf("name starts with a period")
+	}
+	for i := 0; i < len(name); i++ {
+		if !isStoreNameChar(name[i]) {
+			return fmt.Errorf("invalid character %q in name", name[i])
+		}
+	}
+	return nil
+}
+
+// String returns the full path.
+func (p StorePath) String() string {
+	return DefaultStoreDir + "/" + p.BaseName()
+}
+
+// BaseName returns "<hash>-<name>".
+func (p StorePath) BaseName() string {
+	return p.Hash + "-" + p.Name
+}
+
+// FindStorePaths returns the distinct store paths mentioned in s, sorted.
+func FindStorePaths(s string) []StorePath {
+	scanner := NewReferenceScanner(nil)
+	io.WriteString(scanner, s)
+	var paths []StorePath
+	for _, base := range scanner.References() {
+		if p, err := ParseStorePathBase(base); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// MakeStorePath computes a store path the way Nix's makeStorePath does:
+// the hash part is the truncated sha256 of
+// "<type>:sha256:<base16 hash>:<store dir>:<name>".
+func MakeStorePath(typ string, h Hash, name string) (StorePath, error) {
+	if err := checkStoreName(name); err != nil {
+		return StorePath{}, err
+	}
+	if h.Algorithm != "sha256" {
+		return StorePath{}, fmt.Errorf("store paths are computed from sha256 hashes, got %s", h.Algorithm)
+	}
+	s := fmt.Sprintf("%s:sha256:%s:%s:%s", typ, h.Base16(), DefaultStoreDir, name)
+	sum := sha256.Sum256([]byte(s))
+	return StorePath{Hash: EncodeNixBase32(compressHash(sum[:], 20)), Name: name}, nil
+}
+
+// MakeTextPath computes the path of a text file added to the store with
+// builtins.toFile or similar, from the sha256 of its contents and the store
+// paths it refers to.
+func MakeTextPath(name string, contentHash Hash, references []StorePath) (StorePath, error) {
+	return MakeStorePath(storePathType("text", references), contentHash, name)
+}
+
+// MakeFixedOutputPath computes the path of a fixed-output derivation or
+// added source from its output hash. recursive selects outputHashMode =
+// "recursive", where h is the hash of the NAR serialization rather than of
+// a flat file. Only recursive sha256 outputs may have references.
+func MakeFixedOutputPath(name string, h Hash, recursive bool, references []StorePath) (StorePath, error) {
+	if recursive && h.Algorithm == "sha256" {
+		return MakeStorePath(storePathType("source", references), h, name)
+	}
+	if len(references) > 0 {
+		return StorePath{}, fmt.Errorf("fixed-output path %s cannot have references", name)
+	}
+	method := ""
+	if recursive {
+		method = "r:"
+	}
+	inner := sha256.Sum256([]byte(fmt.Sprintf("fixed:out:%s%s:%s:", method, h.Algorithm, h.Base16())))
+	return MakeStorePath("output:out", Hash{Algorithm: "sha256", Digest: inner[:]}, name)
+}
+
+// storePathType appends sorted references to a store path type.
+func storePathType(typ string, references []StorePath) string {
+	refs := make([]string, len(references))
+	for i, r := range references {
+		refs[i] = r.String()
+	}
+	sort.Strings(refs)
+	for _, r := range refs {
+		typ += ":" + r
+	}
+	return typ
+}
+
+// compressHash XOR-folds a hash into size bytes, as Nix does for the hash
+// part of store paths.
+func compressHash(hash []byte, size int) []byte {
+	out := make([]byte, size)
+	for i, b := range hash {
+		out[i%size] ^= b
+	}
+	return out
+}
+
+// VerifySourceFile checks that the regular file at path has the contents
+// its claimed store path implies. The store path may have been made by
+// adding the file as a source (in either executable mode), fetching it as a
+// flat sha256 fixed output, or writing it as a text file whose references
+// are the store paths it mentions.
+func VerifySourceFile(path string, claimed StorePath) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	flat := Hash{Algorithm: "sha256"}
+	sum := sha256.Sum256(data)
+	flat.Digest = sum[:]
+
+	var candidates []StorePath
+	add := func(p StorePath, err error) {
+		if err == nil {
+			candidates = append(candidates, p)
+		}
+	}
+	for _, executable := range []bool{false, true} {
+		add(MakeFixedOutputPath(claimed.Name, regularFileNarHash(data, executable), true, nil))
+	}
+	add(MakeFixedOutputPath(claimed.Name, flat, false, nil))
+	add(MakeTextPath(claimed.Name, flat, FindStorePaths(string(data))))
+
+	for _, p := range candidates {
+		if p == claimed {
+			return nil
+		}
+	}
+	// Report the path it would have as a source, the common case.
+	return &HashMismatchError{
+		What:     "store path",
+		Expected: claimed.String(),
+		Actual:   candidates[0].String(),
+	}
+}
+
+// regularFileNarHash returns the sha256 of the NAR serialization of a
+// single regular file.
+func regularFileNarHash(data []byte, executable bool) Hash {
+	h := sha256.New()
+	nw := &narWriter{w: h}
+	nw.writeStrings("nix-archive-1", "(", "type", "regular")
+	if executable {
+		nw.writeStrings("executable", "")
+	}
+	nw.writeStrings("contents", string(data), ")")
+	return Hash{Algorithm: "sha256", Digest: h.Sum(nil)}
+}
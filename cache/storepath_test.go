@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseStorePath(t *testing.T) {
+	p, err := ParseStorePath("/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Hash != "i3zw7h6pg3n9r5i63iyqxrapa70i4v5w" || p.Name != "hello-2.12.2" || p.String() != "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2" {
+		t.Errorf("ParseStorePath = %+v", p)
+	}
+
+	for _, bad := range []string{
+		"/usr/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello",
+		"/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w",
+		"/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5e-hello", // 'e' is not base32
+		"/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5-hello",  // short hash
+		"/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-.hidden",
+		"/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello/bin/hello",
+		"/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello world",
+	} {
+		if p, err := ParseStorePath(bad); err == nil {
+			t.Errorf("ParseStorePath(%q) = %+v; want an error", bad, p)
+		}
+	}
+}
+
+func TestFindStorePaths(t *testing.T) {
+	env := "/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-glibc-2.40-66/bin:" +
+		"/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2/bin:/usr/bin:" +
+		"/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-glibc-2.40-66/lib"
+	var got []string
+	for _, p := range FindStorePaths(env) {
+		got = append(got, p.BaseName())
+	}
+	want := []string{"i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2", "j193mfi0f921y0kfs8vjc1znnr45ispv-glibc-2.40-66"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FindStorePaths = %v; want %v", got, want)
+	}
+}
+
+func TestMakeFixedOutputPath(t *testing.T) {
+	// default-builder.sh from nixpkgs, added to the store as a source.
+	data := []byte("genericBuild\n")
+	want := "/nix/store/shkw4qm9qcw5sc5n1k5jznc83ny02r39-default-builder.sh"
+	p, err := MakeFixedOutputPath("default-builder.sh", regularFileNarHash(data, false), true, nil)
+	if err != nil || p.String() != want {
+		t.Errorf("MakeFixedOutputPath = %s, %v; want %s", p, err, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "default-builder.sh")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	claimed, _ := ParseStorePath(want)
+	if err := VerifySourceFile(path, claimed); err != nil {
+		t.Errorf("VerifySourceFile: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("tampered\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifySourceFile(path, claimed); err == nil {
+		t.Error("VerifySourceFile accepted modified contents")
+	}
+
+	flat := Hash{Algorithm: "sha256", Digest: make([]byte, 32)}
+	if _, err := MakeFixedOutputPath("x", flat, false, []StorePath{claimed}); err == nil {
+		t.Error("flat fixed-output path with references was accepted")
+	}
+}
+
+func TestMakeTextPathSortsReferences(t *testing.T) {
+	a, _ := ParseStorePath("/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2")
+	b, _ := ParseStorePath("/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-glibc-2.40-66")
+	h := Hash{Algorithm: "sha256", Digest: make([]byte, 32)}
+	p1, err1 := MakeTextPath("script", h, []StorePath{a, b})
+	p2, err2 := MakeTextPath("script", h, []StorePath{b, a})
+	p3, _ := MakeTextPath("script", h, nil)
+	if err1 != nil || err2 != nil || p1 != p2 || p1 == p3 {
+		t.Errorf("MakeTextPath = %s, %s, %s (%v, %v)", p1, p2, p3, err1, err2)
+	}
+}
@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SymlinkManifestName is the sidecar file at the root of an unpacked or
+// built store path that lists the symlinks left out of it.
+//
+// Bazel rejects tree artifacts with dangling symlinks, and a symlink into
+// /nix/store dangles everywhere but inside the sandbox. Such symlinks are
+// recorded in the manifest instead, as a JSON object mapping their paths,
+// slash-separated and relative to the root ("." for the root itself), to
+// their targets. The sandbox recreates them, and WriteNar serializes them
+// as if they were on disk, so the store path keeps its NAR hash.
+const SymlinkManifestName = ".nix-symlinks.json"
+
+// PlaceSymlinks creates the symlinks in links, keyed like the manifest,
+// under root. Symlinks whose targets do not exist, and every symlink into
+// /nix/store, are recorded in root's manifest instead. A symlink is only
+// placed once its target exists, so the order links were found in does not
+// matter.
+func PlaceSymlinks(root string, links map[string]string) error {
+	pending := make(map[string]string, len(links))
+	skipped := make(map[string]string)
+	for rel, target := range links {
+		if strings.HasPrefix(target, "/nix/store/") {
+			skipped[rel] = target
+		} else {
+			pending[rel] = target
+		}
+	}
+
+	for placed := true; placed; {
+		placed = false
+		for _, rel := range sortedKeys(pending) {
+			target := pending[rel]
+			p := filepath.Join(root, filepath.FromSlash(rel))
+			resolved := target
+			if !filepath.IsAbs(target) {
+				resolved = filepath.Join(filepath.Dir(p), target)
+			}
+			if _, err := os.Stat(resolved); err != nil {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(target, p); err != nil {
+				return err
+			}
+			delete(pending, rel)
+			placed = true
+		}
+	}
+	for rel, target := range pending {
+		skipped[rel] = target
+	}
+	if len(skipped) == 0 {
+		return nil
+	}
+
+	// Recorded symlinks need their parent directories, so that the sandbox
+	// can create them and WriteNar can list them.
+	for rel := range skipped {
+		if rel == "." {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(root, filepath.FromSlash(path.Dir(rel))), 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(skipped, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(root, SymlinkManifestName), data, 0644)
+}
+
+// ReadSymlinkManifest returns the symlinks recorded in root's manifest, or
+// nil if it has none.
+func ReadSymlinkManifest(root string) (map[string]string, error) {
+	if info, err := os.Lstat(root); err != nil || !info.IsDir() {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(root, SymlinkManifestName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var links map[string]string
+	if err := json.Unmarshal(data, &links); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(root, SymlinkManifestName), err)
+	}
+	for rel, target := range links {
+		if rel != "." && (!filepath.IsLocal(filepath.FromSlash(rel)) || path.Clean(rel) != rel) {
+			return nil, fmt.Errorf("%s: symlink path %q is outside the store path", filepath.Join(root, SymlinkManifestName), rel)
+		}
+		if target == "" {
+			return nil, fmt.Errorf("%s: symlink %q has no target", filepath.Join(root, SymlinkManifestName), rel)
+		}
+	}
+	return links, nil
+}
+
+// symlinkTree is a file tree with its symlink manifest applied: the
+// recorded symlinks appear in place and the manifest itself is hidden.
+// WriteNar and ListPath both walk a tree through it, so the listing of a
+// store path always agrees with its NAR.
+type symlinkTree struct {
+	root     string
+	symlinks map[string]string
+}
+
+func newSymlinkTree(root string) (symlinkTree, error) {
+	symlinks, err := ReadSymlinkManifest(root)
+	if err != nil {
+		return symlinkTree{}, err
+	}
+	return symlinkTree{root: root, symlinks: symlinks}, nil
+}
+
+// relPath returns path relative to root, in the form used as a key of the
+// symlink manifest.
+func (t symlinkTree) relPath(path string) string {
+	rel, err := filepath.Rel(t.root, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// symlink returns the target of path if the manifest records it.
+func (t symlinkTree) symlink(path string) (string, bool) {
+	target, ok := t.symlinks[t.relPath(path)]
+	return target, ok
+}
+
+// readDir returns the names in the directory at path, sorted.
+func (t symlinkTree) readDir(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if path == t.root && e.Name() == SymlinkManifestName && t.symlinks != nil {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	for rel := range t.symlinks {
+		p := filepath.Join(t.root, filepath.FromSlash(rel))
+		if rel != "." && filepath.Dir(p) == filepath.Clean(path) {
+			names = append(names, filepath.Base(p))
+		}
+	}
+	// os.ReadDir already sorts by name, but the NAR ordering is a
+	// correctness requirement, so make it explicit.
+	sort.Strings(names)
+	return names, nil
+}
@@ -2,9 +2,11 @@ package cache
 
 import (
 	"archive/tar"
-	"compress/bzip2"
+	"bufio"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
@@ -12,41 +14,105 @@ import (
 	"github.com/ulikunitz/xz"
 )
 
+// UnpackOptions tunes how UnpackNarWithOptions extracts an archive.
+type UnpackOptions struct {
+	// Progress, if set, is called with the running total of decompressed
+	// NAR bytes consumed, roughly every ProgressInterval bytes and once more
+	// when extraction finishes.
+	Progress func(done int64)
+
+	// NarHash, if set, is the expected hash of the decompressed NAR in any
+	// form ParseHash accepts, usually "sha256:<base32>" from a narinfo.
+	// NarSize, if nonzero, is its expected length. A mismatch fails the
+	// unpack with a *HashMismatchError.
+	NarHash string
+	NarSize int64
+}
+
+// ProgressInterval is how many NAR bytes are consumed between Progress calls.
+const ProgressInterval = 4 << 20
+
+// narBufferSize bounds the memory used to stream file contents to disk.
+const narBufferSize = 64 << 10
+
+// maxNarStringLen caps the length of NAR tokens, names and symlink targets so
+// a corrupt length field cannot trigger a huge allocation. File contents are
+// streamed and not subject to this limit.
+const maxNarStringLen = 64 << 10
+
 // UnpackNar unpacks a NAR archive to the specified directory.
 // The NAR format is Nix's archive format, which is different from tar.
-// For simplicity, we first decompress, then parse the NAR format.
+// The archive is decompressed and parsed as a stream, so memory use does not
+// depend on the size of the files it contains.
 //
 // NAR format structure:
 // - "nix-archive-1" (magic bytes)
 // - "(" type "regular"/"directory"/"symlink" ... ")"
 func UnpackNar(reader io.Reader, compression string, destDir string) error {
-	// First, decompress based on compression type
-	var decompressed io.Reader
-	var err error
+	return UnpackNarWithOptions(reader, compression, destDir, UnpackOptions{})
+}
 
-	switch compression {
-	case "xz":
-		decompressed, err = xz.NewReader(reader)
+// UnpackNarWithOptions is UnpackNar with progress reporting and other knobs.
+func UnpackNarWithOptions(reader io.Reader, compression string, destDir string, opts UnpackOptions) error {
+	expected := Hash{Algorithm: "sha256"}
+	if opts.NarHash != "" {
+		h, err := ParseHash(opts.NarHash)
 		if err != nil {
-			return fmt.Errorf("failed to create xz reader: %w", err)
+			return fmt.Errorf("invalid expected NAR hash: %w", err)
 		}
-	case "bzip2":
-		decompressed = bzip2.NewReader(reader)
-	case "none", "":
-		decompressed = reader
-	default:
-		return fmt.Errorf("unsupported compression: %s", compression)
+		expected = h
+	}
+
+	// First, decompress based on compression type
+	decompressed, err := NewDecompressor(reader, compression)
+	if err != nil {
+		return err
+	}
+	defer decompressed.Close()
+
+	// Hash everything the decompressor produces. parseNar reads the stream
+	// to its end, so the digest covers all of it.
+	hasher, err := NewHasher(expected.Algorithm)
+	if err != nil {
+		return err
 	}
+	counted := &countingWriter{w: hasher}
+	stream := io.TeeReader(decompressed, counted)
 
 	// Parse and extract NAR
-	return parseNar(decompressed, destDir)
+	nr := newNarReader(stream, opts.Progress)
+	if err := parseNar(nr, destDir); err != nil {
+		return err
+	}
+	nr.reportProgress()
+
+	if opts.NarHash == "" && opts.NarSize == 0 {
+		return nil
+	}
+	if opts.NarSize != 0 && counted.n != opts.NarSize {
+		return &HashMismatchError{
+			What:     "NAR size",
+			Expected: fmt.Sprint(opts.NarSize),
+			Actual:   fmt.Sprint(counted.n),
+		}
+	}
+	if opts.NarHash != "" {
+		if actual := (Hash{Algorithm: expected.Algorithm, Digest: hasher.Sum(nil)}); !actual.Equal(expected) {
+			return &HashMismatchError{
+				What:     "NAR hash",
+				Expected: expected.String(),
+				Actual:   actual.String(),
+			}
+		}
+	}
+	return nil
 }
 
-// parseNar parses the NAR format and extracts files.
+// parseNar parses the NAR format and extracts files. Only canonical NARs,
+// as written by Nix, are accepted: anything else, including data after the
+// root entry, is an error rather than something to skip over.
 // NAR format is a simple S-expression-like format.
-func parseNar(r io.Reader, destDir string) error {
-	// Read magic using NarReader to handle length prefix
-	nr := &NarReader{r: r}
+func parseNar(nr *NarReader, destDir string) error {
 	magic, err := nr.readString()
 	if err != nil {
 		return fmt.Errorf("failed to read magic: %w", err)
@@ -55,60 +121,166 @@ func parseNar(r io.Reader, destDir string) error {
 		return fmt.Errorf("not a NAR archive (magic: %q)", magic)
 	}
 
-	// For now, use a simpler approach: if xz decompression succeeded,
-	// the data should be a valid NAR. We'll implement a basic parser.
-	return extractNarEntry(r, destDir, "")
+	// Symlinks are placed last, once their targets exist; see PlaceSymlinks.
+	symlinks := make(map[string]string)
+	if err := extractNarEntry(nr, destDir, "", symlinks); err != nil {
+		return err
+	}
+	if _, err := nr.r.Peek(1); err != io.EOF {
+		if err != nil {
+			return fmt.Errorf("failed to read past end of NAR: %w", err)
+		}
+		return fmt.Errorf("trailing data after NAR at offset %d", nr.n)
+	}
+
+	links := make(map[string]string, len(symlinks))
+	for p, target := range symlinks {
+		rel, err := filepath.Rel(destDir, p)
+		if err != nil {
+			return err
+		}
+		links[filepath.ToSlash(rel)] = target
+	}
+	return PlaceSymlinks(destDir, links)
 }
 
 // NarReader wraps a reader with NAR-specific parsing utilities.
+// It counts the bytes consumed so callers can report progress.
 type NarReader struct {
-	r io.Reader
+	r   *bufio.Reader
+	buf []byte
+
+	n            int64
+	nextProgress int64
+	progress     func(done int64)
+}
+
+func newNarReader(r io.Reader, progress func(done int64)) *NarReader {
+	return &NarReader{
+		r:            bufio.NewReaderSize(r, narBufferSize),
+		buf:          make([]byte, narBufferSize),
+		nextProgress: ProgressInterval,
+		progress:     progress,
+	}
+}
+
+// Read implements io.Reader, tracking the number of bytes consumed.
+func (nr *NarReader) Read(p []byte) (int, error) {
+	n, err := nr.r.Read(p)
+	nr.n += int64(n)
+	if nr.progress != nil && nr.n >= nr.nextProgress {
+		nr.progress(nr.n)
+		nr.nextProgress = nr.n + ProgressInterval
+	}
+	return n, err
+}
+
+// BytesRead returns the number of NAR bytes consumed so far.
+func (nr *NarReader) BytesRead() int64 {
+	return nr.n
+}
+
+func (nr *NarReader) reportProgress() {
+	if nr.progress != nil {
+		nr.progress(nr.n)
+	}
+}
+
+// readLength reads a NAR length field: an 8-byte little-endian integer.
+func (nr *NarReader) readLength() (uint64, error) {
+	var lenBuf [8]byte
+	if _, err := io.ReadFull(nr, lenBuf[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(lenBuf[:]), nil
+}
+
+// skipPadding consumes the zero bytes that pad a NAR string of the given
+// length to a multiple of 8.
+func (nr *NarReader) skipPadding(length uint64) error {
+	padLen := (8 - (length % 8)) % 8
+	if padLen == 0 {
+		return nil
+	}
+	var pad [8]byte
+	if _, err := io.ReadFull(nr, pad[:padLen]); err != nil {
+		return fmt.Errorf("failed to read padding: %w", err)
+	}
+	if pad != ([8]byte{}) {
+		return fmt.Errorf("non-zero NAR padding at offset %d", nr.n)
+	}
+	return nil
 }
 
 func (nr *NarReader) readString() (string, error) {
 	// NAR strings are: 8-byte little-endian length + data + padding to 8
-	lenBuf := make([]byte, 8)
-	if _, err := io.ReadFull(nr.r, lenBuf); err != nil {
+	length, err := nr.readLength()
+	if err != nil {
 		return "", err
 	}
-	length := int64(lenBuf[0]) | int64(lenBuf[1])<<8 | int64(lenBuf[2])<<16 | int64(lenBuf[3])<<24
 	if length == 0 {
 		return "", nil
 	}
+	if length > maxNarStringLen {
+		return "", fmt.Errorf("NAR string too long (%d bytes)", length)
+	}
 	data := make([]byte, length)
-	if _, err := io.ReadFull(nr.r, data); err != nil {
+	if _, err := io.ReadFull(nr, data); err != nil {
 		return "", err
 	}
-	// Skip padding
-	padLen := (8 - (length % 8)) % 8
-	if padLen > 0 {
-		pad := make([]byte, padLen)
-		io.ReadFull(nr.r, pad)
+	if err := nr.skipPadding(length); err != nil {
+		return "", err
 	}
 	return string(data), nil
 }
 
-// extractNarEntry extracts a NAR entry (file, directory, symlink).
-func extractNarEntry(r io.Reader, baseDir, name string) error {
-	nr := &NarReader{r: r}
-
-	// Read opening paren
-	token, err := nr.readString()
+// expect reads a string and checks that it is want.
+func (nr *NarReader) expect(want string) error {
+	got, err := nr.readString()
 	if err != nil {
 		return err
 	}
-	if token != "(" {
-		return fmt.Errorf("expected '(', got %q", token)
+	if got != want {
+		return fmt.Errorf("expected %q at offset %d, got %q", want, nr.n, got)
 	}
+	return nil
+}
 
-	// Read "type"
-	token, _ = nr.readString()
-	if token != "type" {
-		return fmt.Errorf("expected 'type', got %q", token)
+// copyContents streams a length-prefixed NAR string to w without holding it
+// in memory.
+func (nr *NarReader) copyContents(w io.Writer) error {
+	length, err := nr.readLength()
+	if err != nil {
+		return err
+	}
+	if length > math.MaxInt64 {
+		return fmt.Errorf("NAR file too large (%d bytes)", length)
 	}
+	n, err := io.CopyBuffer(w, io.LimitReader(nr, int64(length)), nr.buf)
+	if err != nil {
+		return err
+	}
+	// A truncated archive ends the LimitReader early without an error.
+	if uint64(n) != length {
+		return io.ErrUnexpectedEOF
+	}
+	return nr.skipPadding(length)
+}
 
-	// Read type value
-	entryType, _ := nr.readString()
+// extractNarEntry extracts a NAR entry (file, directory, symlink).
+// name has already been checked by validNarName, so the entry stays inside
+// baseDir. Symlinks are not created but added to symlinks, keyed by path.
+func extractNarEntry(nr *NarReader, baseDir, name string, symlinks map[string]string) error {
+	if err := nr.expect("("); err != nil {
+		return err
+	}
+	if err := nr.expect("type"); err != nil {
+		return err
+	}
+	entryType, err := nr.readString()
+	if err != nil {
+		return err
+	}
 
 	destPath := filepath.Join(baseDir, name)
 
@@ -116,17 +288,40 @@ func extractNarEntry(r io.Reader, baseDir, name string) error {
 	case "regular":
 		return extractRegularFile(nr, destPath)
 	case "directory":
-		return extractDirectory(nr, destPath)
+		return extractDirectory(nr, destPath, symlinks)
 	case "symlink":
-		return extractSymlink(nr, destPath)
+		return extractSymlink(nr, destPath, symlinks)
 	default:
-		return fmt.Errorf("unknown entry type: %s", entryType)
+		return fmt.Errorf("unknown entry type: %q", entryType)
 	}
 }
 
+// validNarName reports whether name can be a directory entry: a single,
+// non-empty path component.
+func validNarName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
 func extractRegularFile(nr *NarReader, destPath string) error {
-	var executable bool
-	var contents []byte
+	// Handle case where destPath is an existing directory (single-file NAR at root)
+	if info, err := os.Stat(destPath); err == nil && info.IsDir() {
+		// Use the basename of the store path as the filename, or "content" if unknown
+		destPath = filepath.Join(destPath, "content")
+	} else {
+		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+			return err
+		}
+	}
+
+	// "executable" precedes "contents" in canonical NARs, so the mode is
+	// known before the body is streamed. Create the file up front so empty
+	// files without a "contents" field still exist.
+	var executable, haveContents bool
+	f, err := os.OpenFile(destPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
 
 	for {
 		token, err := nr.readString()
@@ -137,66 +332,36 @@ func extractRegularFile(nr *NarReader, destPath string) error {
 			break
 		}
 
-		switch token {
-		case "executable":
-			// Next token is empty string
-			nr.readString()
-			executable = true
-		case "contents":
-			data, err := readContents(nr)
-			if err != nil {
+		switch {
+		case token == "executable" && !executable && !haveContents:
+			if err := nr.expect(""); err != nil {
 				return err
 			}
-			contents = data
+			executable = true
+		case token == "contents" && !haveContents:
+			if err := nr.copyContents(f); err != nil {
+				return fmt.Errorf("failed to write %s: %w", destPath, err)
+			}
+			haveContents = true
+		default:
+			return fmt.Errorf("unexpected %q in regular file %s", token, destPath)
 		}
 	}
 
-	// Handle case where destPath is an existing directory (single-file NAR at root)
-	if info, err := os.Stat(destPath); err == nil && info.IsDir() {
-		// Use the basename of the store path as the filename, or "content" if unknown
-		destPath = filepath.Join(destPath, "content")
-	} else {
-		if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+	if executable {
+		if err := f.Chmod(0755); err != nil {
 			return err
 		}
 	}
-
-	mode := os.FileMode(0644)
-	if executable {
-		mode = 0755
-	}
-
-	return os.WriteFile(destPath, contents, mode)
+	return f.Close()
 }
 
-func readContents(nr *NarReader) ([]byte, error) {
-	// Read length
-	lenBuf := make([]byte, 8)
-	if _, err := io.ReadFull(nr.r, lenBuf); err != nil {
-		return nil, err
-	}
-	length := int64(lenBuf[0]) | int64(lenBuf[1])<<8 | int64(lenBuf[2])<<16 | int64(lenBuf[3])<<24
-
-	data := make([]byte, length)
-	if _, err := io.ReadFull(nr.r, data); err != nil {
-		return nil, err
-	}
-
-	// Skip padding
-	padLen := (8 - (length % 8)) % 8
-	if padLen > 0 {
-		pad := make([]byte, padLen)
-		io.ReadFull(nr.r, pad)
-	}
-
-	return data, nil
-}
-
-func extractDirectory(nr *NarReader, destPath string) error {
+func extractDirectory(nr *NarReader, destPath string, symlinks map[string]string) error {
 	if err := os.MkdirAll(destPath, 0755); err != nil {
 		return err
 	}
 
+	var prev string
 	for {
 		token, err := nr.readString()
 		if err != nil {
@@ -209,64 +374,62 @@ func extractDirectory(nr *NarReader, destPath string) error {
 			return fmt.Errorf("expected 'entry' or ')', got %q", token)
 		}
 
-		// Read entry
-		nr.readString() // "("
-		nr.readString() // "name"
-		entryName, _ := nr.readString()
-		nr.readString() // "node"
-
-		if err := extractNarEntry(nr.r, destPath, entryName); err != nil {
+		if err := nr.expect("("); err != nil {
 			return err
 		}
-
-		nr.readString() // ")"
-	}
-
-	return nil
-}
-
-func extractSymlink(nr *NarReader, destPath string) error {
-	var target string
-
-	for {
-		token, err := nr.readString()
+		if err := nr.expect("name"); err != nil {
+			return err
+		}
+		entryName, err := nr.readString()
 		if err != nil {
 			return err
 		}
-		if token == ")" {
-			break
+		if !validNarName(entryName) {
+			return fmt.Errorf("invalid entry name %q in %s", entryName, destPath)
+		}
+		// Entries are sorted, which also rules out duplicates.
+		if prev != "" && entryName <= prev {
+			return fmt.Errorf("entry %q in %s is not sorted after %q", entryName, destPath, prev)
+		}
+		prev = entryName
+		if err := nr.expect("node"); err != nil {
+			return err
 		}
-		if token == "target" {
-			target, _ = nr.readString()
+
+		if err := extractNarEntry(nr, destPath, entryName, symlinks); err != nil {
+			return err
+		}
+
+		if err := nr.expect(")"); err != nil {
+			return err
 		}
 	}
 
-	// Create parent directories first
-	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+	return nil
+}
+
+func extractSymlink(nr *NarReader, destPath string, symlinks map[string]string) error {
+	if err := nr.expect("target"); err != nil {
 		return err
 	}
-
-	// Skip symlinks that would dangle:
-	// 1. Absolute symlinks to /nix/store (resolved at runtime via mounts)
-	// 2. Relative symlinks where target doesn't exist (e.g., points to other store paths)
-	if strings.HasPrefix(target, "/nix/store/") {
-		return nil
+	target, err := nr.readString()
+	if err != nil {
+		return err
 	}
-
-	// For relative symlinks, check if target would exist
-	resolvedTarget := target
-	if !filepath.IsAbs(target) {
-		resolvedTarget = filepath.Join(filepath.Dir(destPath), target)
+	if target == "" || strings.ContainsRune(target, 0) {
+		return fmt.Errorf("invalid symlink target %q for %s", target, destPath)
 	}
-	if _, err := os.Stat(resolvedTarget); os.IsNotExist(err) {
-		// Target doesn't exist - skip this symlink to avoid Bazel validation error
-		return nil
+	if err := nr.expect(")"); err != nil {
+		return err
 	}
-
-	return os.Symlink(target, destPath)
+	symlinks[destPath] = target
+	return nil
 }
 
 // UnpackTarXz is a fallback for tar.xz archives (used by some derivations).
+// Entries must stay inside destDir: names may not escape it, directly or
+// through a symlink extracted earlier, and link targets must resolve inside
+// it.
 func UnpackTarXz(reader io.Reader, destDir string) error {
 	xzReader, err := xz.NewReader(reader)
 	if err != nil {
@@ -284,7 +447,11 @@ func UnpackTarXz(reader io.Reader, destDir string) error {
 			return fmt.Errorf("tar error: %w", err)
 		}
 
-		target := filepath.Join(destDir, header.Name)
+		name, err := tarEntryPath(destDir, header.Name)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destDir, name)
 
 		switch header.Typeflag {
 		case tar.TypeDir:
@@ -303,16 +470,83 @@ func UnpackTarXz(reader io.Reader, destDir string) error {
 				f.Close()
 				return err
 			}
-			f.Close()
+			if err := f.Close(); err != nil {
+				return err
+			}
 		case tar.TypeSymlink:
+			if !localLinkTarget(name, header.Linkname) {
+				return fmt.Errorf("tar entry %q links outside the archive: %q", header.Name, header.Linkname)
+			}
 			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return err
 			}
 			if err := os.Symlink(header.Linkname, target); err != nil {
 				return err
 			}
+		case tar.TypeLink:
+			old, err := tarEntryPath(destDir, header.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Link(filepath.Join(destDir, old), target); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
+
+// tarEntryPath returns name cleaned and relative to destDir, failing if it
+// would leave destDir or pass through a symlink already extracted there.
+func tarEntryPath(destDir, name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("tar entry %q is outside the archive", name)
+	}
+	if rel == "." {
+		return rel, nil
+	}
+	dir := destDir
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("tar entry %q passes through symlink %s", name, dir)
+		}
+	}
+	return rel, nil
+}
+
+// localLinkTarget reports whether a symlink at name pointing to target
+// stays inside the archive. Since no entry is extracted through a symlink,
+// a relative target whose ".." components all come first resolves the same
+// way physically as lexically; ".." after another component could instead
+// climb out of a symlinked directory.
+func localLinkTarget(name, target string) bool {
+	if target == "" || filepath.IsAbs(target) {
+		return false
+	}
+	leading := true
+	for _, part := range strings.Split(filepath.ToSlash(target), "/") {
+		switch part {
+		case "..":
+			if !leading {
+				return false
+			}
+		case ".", "":
+		default:
+			leading = false
+		}
+	}
+	return filepath.IsLocal(filepath.Join(filepath.Dir(name), target))
+}
@@ -8,6 +8,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
 	"github.com/JonathanPerry651/nix-bazel-via-bwrap/pkg/sandbox"
 )
 
@@ -19,7 +20,7 @@ type OutputMapping struct {
 
 func main() {
 	if len(os.Args) < 3 {
-		log.Fatalf("Usage: %s <builder> <realOutDirBase> [--mount host:sandbox...] -- [builderArgs...]", os.Args[0])
+		log.Fatalf("Usage: %s <builder|drv> <realOutDirBase> [--mount host:sandbox...] -- [builderArgs...]", os.Args[0])
 	}
 
 	builder := os.Args[1]
@@ -48,6 +49,28 @@ func main() {
 		builderArgs = append(builderArgs, arg)
 	}
 
+	// A .drv file in place of the builder supplies the builder, its
+	// arguments, environment and (unless given explicitly) outputs.
+	var drv *cache.Derivation
+	if strings.HasSuffix(builder, ".drv") {
+		d, err := cache.ReadDerivation(builder)
+		if err != nil {
+			log.Fatalf("Failed to read derivation: %v", err)
+		}
+		drv = d
+		builder = drv.Builder
+		builderArgs = append(append([]string(nil), drv.Args...), builderArgs...)
+		if len(explicitOutputs) == 0 {
+			for name, out := range drv.Outputs {
+				if out.Path == "" {
+					log.Printf("WARNING: Output %s has no fixed store path, skipping.\n", name)
+					continue
+				}
+				explicitOutputs = append(explicitOutputs, name+":"+out.Path)
+			}
+		}
+	}
+
 	// Parse Outputs
 	var outputMappings []OutputMapping
 	for _, mapping := range explicitOutputs {
@@ -154,6 +177,12 @@ func main() {
 
 	// Handle Builtins vs Real Build
 	if strings.HasPrefix(builder, "builtin:") {
+		// Builtins read their parameters from the derivation's environment,
+		// as in Nix, or from ours when run without a derivation.
+		env := environ()
+		if drv != nil {
+			env = drv.Env
+		}
 		for _, om := range outputMappings {
 			dest := filepath.Join(hostStore, filepath.Base(om.StorePath))
 			src := om.StorePath
@@ -161,7 +190,7 @@ func main() {
 				src = hostSrc
 			}
 
-			if err := sandbox.HandleBuiltin(builder, src, dest); err != nil {
+			if err := sandbox.HandleBuiltin(builder, src, dest, env); err != nil {
 				log.Fatalf("Builtin failed: %v", err)
 			}
 		}
@@ -183,6 +212,14 @@ func main() {
 			WorkDir:  "/build",
 			ShareNet: true,
 		}
+		if drv != nil {
+			// The sandbox's own variables take precedence.
+			for k, v := range drv.Env {
+				if _, ok := cfg.Envs[k]; !ok {
+					cfg.Envs[k] = v
+				}
+			}
+		}
 
 		// Always mount system libs for builder to ensure generic builders work (e.g. /bin/sh)
 		// Builders are assumed to be non-hermetic until we enforce pure builders strictly.
@@ -222,6 +259,11 @@ func main() {
 			log.Printf("Warning: EnsureShell failed: %v", err)
 		}
 
+		// Input store paths get back the symlinks unpacking left out.
+		if err := cfg.RestoreStoreSymlinks(); err != nil {
+			log.Fatalf("Failed to restore store symlinks: %v", err)
+		}
+
 		bwrapArgs, err := sandbox.BuildBwrapArgs(&cfg)
 		if err != nil {
 			log.Fatalf("Failed to build bwrap args: %v", err)
@@ -281,3 +323,14 @@ func main() {
 		}
 	}
 }
+
+// environ returns the process environment as a map.
+func environ() map[string]string {
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			env[k] = v
+		}
+	}
+	return env
+}
@@ -221,6 +221,11 @@ func main() {
 		}
 	}
 
+	// Symlinks left out of the unpacked store paths
+	if err := cfg.RestoreStoreSymlinks(); err != nil {
+		log.Fatalf("Failed to restore store symlinks: %v", err)
+	}
+
 	bwrapArgs, err := sandbox.BuildBwrapArgs(cfg)
 	if err != nil {
 		log.Fatalf("Failed to build bwrap args: %v", err)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+// runDiff compares the flakes of two lockfiles, like
+// `nix store diff-closures` over their runtime closures.
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the differences as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: nix_tool diff [-json] <old.lock> <new.lock>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	before, err := cache.LoadLockFile(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("Failed to load %s: %v", fs.Arg(0), err)
+	}
+	after, err := cache.LoadLockFile(fs.Arg(1))
+	if err != nil {
+		log.Fatalf("Failed to load %s: %v", fs.Arg(1), err)
+	}
+	diffs := cache.DiffLockFiles(before, after)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(diffs); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	for _, d := range diffs {
+		name := d.Label
+		if d.System != "" {
+			name += " (" + d.System + ")"
+		}
+		fmt.Printf("%s: %s; closure %s, download %s\n", name, d.Change,
+			sizeChange(d.OldNarSize, d.NewNarSize), sizeChange(d.OldFileSize, d.NewFileSize))
+		for _, p := range d.Packages {
+			line := fmt.Sprintf("  %s: %s → %s", p.Name, versions(p.OldVersions), versions(p.NewVersions))
+			if p.NarSizeDelta != 0 {
+				line += ", " + signedBytes(p.NarSizeDelta)
+			}
+			fmt.Println(line)
+		}
+	}
+}
+
+// versions formats a version set the way `nix store diff-closures` does:
+// ∅ for an absent package and ε for an empty version.
+func versions(vs []string) string {
+	if vs == nil {
+		return "∅"
+	}
+	out := make([]string, len(vs))
+	for i, v := range vs {
+		if v == "" {
+			v = "ε"
+		}
+		out[i] = v
+	}
+	return strings.Join(out, ", ")
+}
+
+func sizeChange(before, after int64) string {
+	return fmt.Sprintf("%s → %s (%s)", bytesString(before), bytesString(after), signedBytes(after-before))
+}
+
+func signedBytes(n int64) string {
+	if n < 0 {
+		return "-" + bytesString(-n)
+	}
+	return "+" + bytesString(n)
+}
+
+func bytesString(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	default:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+}
@@ -1,31 +1,42 @@
+// Command nix_tool unpacks and publishes NARs for the Bazel rules, checks
+// vendored store paths, compares lockfiles and maintains the shared local
+// store.
+//
+// Usage:
+//
+//	nix_tool [unpack] -src <nar> -dest <dir> [flags]
+//	nix_tool publish -src <dir> -store-path <path> -cache <dir> [flags]
+//	nix_tool verify-sources [-dir nix_deps/nix_sources]
+//	nix_tool diff [-json] <old.lock> <new.lock>
+//	nix_tool optimise [-store <dir>]
+//
+// Without a subcommand, nix_tool unpacks, which is how nix_nar_unpack
+// invokes it.
 package main
 
 import (
-	"flag"
-	"log"
+	"fmt"
 	"os"
-
-	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+	"strings"
 )
 
-func main() {
-	src := flag.String("src", "", "Source NAR archive path")
-	dest := flag.String("dest", "", "Destination directory")
-	compression := flag.String("compression", "xz", "Compression type (xz, bzip2, none)")
-	flag.Parse()
-
-	if *src == "" || *dest == "" {
-		flag.Usage()
-		os.Exit(1)
-	}
-
-	f, err := os.Open(*src)
-	if err != nil {
-		log.Fatalf("Failed to open source: %v", err)
-	}
-	defer f.Close()
+var commands = map[string]func(args []string){
+	"unpack":         runUnpack,
+	"publish":        runPublish,
+	"verify-sources": runVerifySources,
+	"diff":           runDiff,
+	"optimise":       runOptimise,
+}
 
-	if err := cache.UnpackNar(f, *compression, *dest); err != nil {
-		log.Fatalf("Failed to unpack NAR: %v", err)
+func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		run, ok := commands[os.Args[1]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "nix_tool: unknown command %q\n", os.Args[1])
+			os.Exit(2)
+		}
+		run(os.Args[2:])
+		return
 	}
+	runUnpack(os.Args[1:])
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+// localStoreEnv names the environment variable holding the shared local
+// store directory. Pass it to nix_nar_unpack actions with --action_env.
+const localStoreEnv = "NIX_BAZEL_LOCAL_STORE"
+
+// runOptimise hard-links identical files across the shared local store,
+// like `nix-store --optimise`.
+func runOptimise(args []string) {
+	fs := flag.NewFlagSet("optimise", flag.ExitOnError)
+	store := fs.String("store", os.Getenv(localStoreEnv), "Shared local store directory; defaults to $"+localStoreEnv+" or the per-user cache")
+	fs.Parse(args)
+
+	if *store == "" {
+		dir, err := cache.DefaultLocalStoreDir()
+		if err != nil {
+			log.Fatalf("Failed to find the local store: %v", err)
+		}
+		*store = dir
+	}
+	report, err := cache.NewLocalStore(*store).Optimise()
+	if err != nil {
+		log.Fatalf("Failed to optimise %s: %v", *store, err)
+	}
+	fmt.Printf("%d files linked, %s freed\n", report.Files, bytesString(report.BytesSaved))
+}
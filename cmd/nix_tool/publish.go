@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func runPublish(args []string) {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	src := fs.String("src", "", "Tree artifact (or file) holding the output's contents")
+	storePath := fs.String("store-path", "", "Store path the contents belong to, e.g. /nix/store/<hash>-hello-2.12")
+	cacheDir := fs.String("cache", "", "Binary cache directory to write into")
+	compression := fs.String("compression", cache.DefaultPublishCompression, "NAR compression (none, xz, zstd, gzip, br, lzip)")
+	secretKeyFile := fs.String("secret-key-file", "", "File holding an ed25519 secret key (name:base64) to sign the narinfo with")
+	deriver := fs.String("deriver", "", "Store path of the .drv that built the output")
+	var refs stringList
+	fs.Var(&refs, "reference", "Store path the output may refer to; repeatable. If omitted, any store path found in the output is recorded")
+	fs.Parse(args)
+
+	if *src == "" || *storePath == "" || *cacheDir == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	opts := cache.PublishOptions{
+		Compression:         *compression,
+		ReferenceCandidates: refs,
+		Deriver:             *deriver,
+	}
+	if *secretKeyFile != "" {
+		data, err := os.ReadFile(*secretKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read secret key: %v", err)
+		}
+		key, err := cache.ParseSecretKey(string(data))
+		if err != nil {
+			log.Fatalf("Failed to parse secret key: %v", err)
+		}
+		opts.SecretKey = &key
+	}
+
+	info, err := cache.Publish(*cacheDir, *storePath, *src, opts)
+	if err != nil {
+		log.Fatalf("Failed to publish %s: %v", *storePath, err)
+	}
+	log.Printf("Published %s as %s (%d references)", info.StorePath, info.URL, len(info.References))
+}
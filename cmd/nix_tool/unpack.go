@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+func runUnpack(args []string) {
+	fs := flag.NewFlagSet("unpack", flag.ExitOnError)
+	src := fs.String("src", "", "Source NAR archive path")
+	dest := fs.String("dest", "", "Destination directory")
+	compression := fs.String("compression", cache.DefaultCompression, "Compression type ("+strings.Join(cache.Compressions, ", ")+")")
+	narHash := fs.String("nar-hash", "", "Expected hash of the decompressed NAR (SRI or <algo>:<base16|base32|base64>)")
+	narSize := fs.Int64("nar-size", 0, "Expected size in bytes of the decompressed NAR")
+	progress := fs.Bool("progress", false, "Log the number of NAR bytes unpacked as extraction proceeds")
+	store := fs.String("store", os.Getenv(localStoreEnv), "Shared local store to unpack into once and link from (needs -nar-hash); defaults to $"+localStoreEnv)
+	fs.Parse(args)
+
+	if *src == "" || *dest == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+
+	f, err := os.Open(*src)
+	if err != nil {
+		log.Fatalf("Failed to open source: %v", err)
+	}
+	defer f.Close()
+
+	opts := cache.UnpackOptions{
+		NarHash: *narHash,
+		NarSize: *narSize,
+	}
+	if *progress {
+		opts.Progress = func(done int64) {
+			log.Printf("Unpacked %d MiB of %s", done>>20, *src)
+		}
+	}
+
+	if *store == "" || *narHash == "" {
+		if err := cache.UnpackNarWithOptions(f, *compression, *dest, opts); err != nil {
+			log.Fatalf("Failed to unpack NAR: %v", err)
+		}
+		return
+	}
+
+	ls := cache.NewLocalStore(*store)
+	entry, err := ls.Unpack(f, *compression, opts)
+	if err != nil {
+		log.Fatalf("Failed to unpack NAR into %s: %v", *store, err)
+	}
+	if err := ls.Link(entry, *dest); err != nil {
+		log.Fatalf("Failed to link %s: %v", entry, err)
+	}
+}
@@ -1,16 +1,140 @@
 load("@bazel_tools//tools/build_defs/repo:http.bzl", "http_archive")
 
-def _nix_cache_repo_impl(ctx):
-    content = ctx.read(ctx.path(ctx.attr.lockfile))
+# File extensions Nix uses for each narinfo Compression value.
+_COMPRESSION_EXTENSIONS = {
+    "none": "",
+    "xz": ".xz",
+    "bzip2": ".bz2",
+    "zstd": ".zst",
+    "gzip": ".gz",
+    "br": ".br",
+    "lzip": ".lz",
+}
+
+# Compression of a store path whose lockfile entry has none; a narinfo
+# without a Compression field means bzip2. nix_nar_unpack defaults to the
+# same value.
+_DEFAULT_COMPRESSION = "bzip2"
+
+def _nar_url(ctx, url):
+    # Gazelle records NARs from local caches inside the workspace relative to
+    # its root, so the lockfile is portable between checkouts.
+    if "://" in url:
+        return url
+    return "file://%s/%s" % (ctx.workspace_root, url)
+
+# Lockfile schema versions this extension reads. The newest must match
+# cache.CurrentLockFileVersion; Gazelle upgrades older lockfiles, but the
+# extension reads any version from 2 on, the first with an integrity for
+# every store path, as long as it uses no feature newer than its version.
+_LOCKFILE_VERSION = 4
+_MIN_LOCKFILE_VERSION = 2
+
+# First schema versions with the sharded layout and per-system outputs.
+_SHARDED_LOCKFILE_VERSION = 3
+_SYSTEMS_LOCKFILE_VERSION = 4
+
+_REQUIRED_STORE_PATH_KEYS = ["store_path", "nar_url", "nar_hash", "integrity", "file_size"]
+_REQUIRED_FLAKE_KEYS = ["drv_hash", "output_store_path"]
+
+# Platform constraints of the Nix systems Gazelle can evaluate flakes for;
+# nix_cache generates a "system_<system>" config_setting for each.
+_NIX_SYSTEM_CONSTRAINTS = {
+    "x86_64-linux": ["@platforms//os:linux", "@platforms//cpu:x86_64"],
+    "aarch64-linux": ["@platforms//os:linux", "@platforms//cpu:aarch64"],
+    "x86_64-darwin": ["@platforms//os:macos", "@platforms//cpu:x86_64"],
+    "aarch64-darwin": ["@platforms//os:macos", "@platforms//cpu:aarch64"],
+}
+
+# Upper bound on directories visited in a sharded lockfile; Starlark has no
+# while loop.
+_MAX_SHARD_DIRS = 100000
+
+def _read_shards(ctx, lock_path, lockfile):
+    """Merges the fragments of a sharded lockfile (see cache.LockFileLayoutSharded)."""
+    shard_dir = lock_path.dirname.get_child(lock_path.basename + ".d")
+    if not shard_dir.exists:
+        fail("%s uses the sharded layout, but %s is missing" % (lockfile, shard_dir))
+    flakes = {}
+    store_paths = {}
+
+    pending = [shard_dir.get_child("flakes")]
+    for _ in range(_MAX_SHARD_DIRS):
+        if not pending:
+            break
+        d = pending.pop()
+        if not d.exists:
+            continue
+        for child in d.readdir():
+            if child.is_dir:
+                pending.append(child)
+            elif child.basename == "lock.json":
+                flakes.update(json.decode(ctx.read(child)))
+    if pending:
+        fail("%s: too many directories in %s" % (lockfile, shard_dir))
+
+    index_dir = shard_dir.get_child("store_paths")
+    if index_dir.exists:
+        for child in index_dir.readdir():
+            if child.basename.endswith(".json"):
+                info = json.decode(ctx.read(child))
+                if child.basename != info.get("store_path", "").split("/")[-1] + ".json":
+                    fail("%s: %s does not describe its own store path" % (lockfile, child))
+                store_paths[info["store_path"]] = info
+    return flakes, store_paths
+
+def _decode_lockfile(ctx, lock_path, lockfile):
+    """Decodes and validates a lockfile, failing with the offending entry."""
+    content = ctx.read(lock_path)
     if not content.strip():
-        lock_content = {"version": 1, "flakes": {}, "store_paths": {}}
-    else:
-        lock_content = json.decode(content)
+        return {"version": _LOCKFILE_VERSION, "flakes": {}, "store_paths": {}}
+    lock = json.decode(content)
+    version = lock.get("version", 0)
+    if type(version) != "int" or version < _MIN_LOCKFILE_VERSION or version > _LOCKFILE_VERSION:
+        fail("%s has schema version %s, but this version of nix_bazel_via_bwrap reads versions %d to %d. Re-run Gazelle to upgrade it." % (lockfile, version, _MIN_LOCKFILE_VERSION, _LOCKFILE_VERSION))
+    if lock.get("layout") == "sharded":
+        if version < _SHARDED_LOCKFILE_VERSION:
+            fail("%s uses the sharded layout, which needs schema version %d, but has version %d" % (lockfile, _SHARDED_LOCKFILE_VERSION, version))
+        flakes, store_paths = _read_shards(ctx, lock_path, lockfile)
+        lock["flakes"] = flakes
+        lock["store_paths"] = store_paths
+    elif lock.get("layout"):
+        fail("%s has unknown layout '%s'" % (lockfile, lock["layout"]))
+    lock.setdefault("flakes", {})
+    lock.setdefault("store_paths", {})
+    for path, info in lock["store_paths"].items():
+        for key in _REQUIRED_STORE_PATH_KEYS:
+            if key not in info:
+                fail("%s: store path %s is missing '%s'" % (lockfile, path, key))
+        if info["store_path"] != path:
+            fail("%s: store path %s has store_path '%s'" % (lockfile, path, info["store_path"]))
+    for label, flake in lock["flakes"].items():
+        if "systems" not in flake:
+            for key in _REQUIRED_FLAKE_KEYS:
+                if key not in flake:
+                    fail("%s: flake %s is missing '%s'" % (lockfile, label, key))
+            continue
+        if version < _SYSTEMS_LOCKFILE_VERSION:
+            fail("%s: flake %s has per-system outputs, which need schema version %d, but the lockfile has version %d" % (lockfile, label, _SYSTEMS_LOCKFILE_VERSION, version))
+        for system, out in flake["systems"].items():
+            if system not in _NIX_SYSTEM_CONSTRAINTS:
+                fail("%s: flake %s has unsupported system '%s'" % (lockfile, label, system))
+            for key in _REQUIRED_FLAKE_KEYS:
+                if key not in out:
+                    fail("%s: flake %s (%s) is missing '%s'" % (lockfile, label, system, key))
+    return lock
+
+def _nix_cache_repo_impl(ctx):
+    lock_content = _decode_lockfile(ctx, ctx.path(ctx.attr.lockfile), ctx.attr.lockfile)
     
     # Header for root BUILD file
     root_build = ['exports_files(glob(["blobs/**"]))', 'load("@nix_bazel_via_bwrap//:rules.bzl", "nix_nar_unpack")']
     root_build.append('package(default_visibility = ["//visibility:public"])')
 
+    # Per-system outputs of multi-system flakes are selected on these.
+    for system, constraints in _NIX_SYSTEM_CONSTRAINTS.items():
+        root_build.append('config_setting(name = "system_%s", constraint_values = %s)' % (system, constraints))
+
     # 1. Process Store Paths (Dependencies)
     # Generate nix_nar_unpack targets in root package (or separate package?)
     # Root package is simplest for visibility.
@@ -33,16 +157,18 @@ def _nix_cache_repo_impl(ctx):
             target_name = path_to_label[path].replace("//:", "") # Retrieve name
             
             # Download NAR
-            nar_filename = "blobs/" + info["nar_hash"].replace(":", "_") + ".nar.xz"
+            compression = info.get("compression") or _DEFAULT_COMPRESSION
+            if compression not in _COMPRESSION_EXTENSIONS:
+                fail("unsupported compression '%s' for %s" % (compression, path))
+            nar_filename = "blobs/" + info["nar_hash"].replace(":", "_") + ".nar" + _COMPRESSION_EXTENSIONS[compression]
             
             download_args = {
-                "url": info["nar_url"],
+                "url": [_nar_url(ctx, u) for u in [info["nar_url"]] + info.get("mirror_urls", [])],
                 "output": nar_filename,
-                "sha256": info["nar_hash"].replace("sha256:", ""),
             }
-            if info.get("integrity"):
-                download_args["integrity"] = info["integrity"]
-                
+
+            download_args["integrity"] = info["integrity"]
+
             ctx.download(**download_args)
             
             # Resolve references for deps
@@ -60,7 +186,13 @@ def _nix_cache_repo_impl(ctx):
                 if ref_path in path_to_label:
                      deps_labels.append(path_to_label[ref_path])
             
-            root_build.append('nix_nar_unpack(name = "%s", src = "%s", store_path = "%s", deps = %s)' % (target_name, nar_filename, path, deps_labels))
+            verify_attrs = ""
+            if info.get("nar_content_hash"):
+                verify_attrs += ', nar_hash = "%s"' % info["nar_content_hash"]
+            if info.get("nar_size"):
+                verify_attrs += ', nar_size = "%d"' % info["nar_size"]
+
+            root_build.append('nix_nar_unpack(name = "%s", src = "%s", store_path = "%s", compression = "%s"%s, deps = %s)' % (target_name, nar_filename, path, compression, verify_attrs, deps_labels))
 
     # Symlink nix_sources if present (for reproducible source references)
     lock_path = ctx.path(ctx.attr.lockfile)
@@ -96,6 +228,31 @@ def _nix_cache_repo_impl(ctx):
 
         build_content = build_files[build_file_path]
         
+        # Multi-system flakes pick their output with select(); the target is
+        # named after the executable, which is the same on every system.
+        if "systems" in flake:
+            systems = sorted(flake["systems"].keys())
+            executable = flake["systems"][systems[0]].get("executable")
+            if not executable:
+                continue
+            build_content.append('nix_binary(')
+            build_content.append('    name = "%s",' % executable)
+            build_content.append('    exe_path = select({')
+            for system in systems:
+                out = flake["systems"][system]
+                build_content.append('        "//:system_%s": "%s/%s",' % (system, out["output_store_path"], out.get("executable", executable)))
+            build_content.append('    }, no_match_error = "%s is only locked for %s"),' % (label, ", ".join(systems)))
+            build_content.append('    mounts = select({')
+            for system in systems:
+                build_content.append('        "//:system_%s": {' % system)
+                for p in flake["systems"][system].get("runtime_closure", []):
+                    if p in path_to_label:
+                        build_content.append('            "%s": "%s",' % (path_to_label[p], p))
+                build_content.append('        },')
+            build_content.append('    }, no_match_error = "%s is only locked for %s"),' % (label, ", ".join(systems)))
+            build_content.append(')')
+            continue
+
         # Determine strict output path for main executable
         if flake.get("executable"):
             # Target name: "bin/hello"
@@ -5,13 +5,16 @@ go 1.22.9
 toolchain go1.24.11
 
 require (
+	github.com/andybalholm/brotli v1.2.0
 	github.com/bazelbuild/bazel-gazelle v0.47.0
+	github.com/bazelbuild/buildtools v0.0.0-20251231073631-eb7356da6895
 	github.com/bazelbuild/rules_go v0.59.0
+	github.com/klauspost/compress v1.18.0
+	github.com/sorairolake/lzip-go v0.3.8
 	github.com/ulikunitz/xz v0.5.15
 )
 
 require (
-	github.com/bazelbuild/buildtools v0.0.0-20251231073631-eb7356da6895 // indirect
 	golang.org/x/mod v0.23.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/tools/go/vcs v0.1.0-deprecated // indirect
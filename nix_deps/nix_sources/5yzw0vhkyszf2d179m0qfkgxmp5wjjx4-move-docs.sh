@@ -19,7 +19,7 @@ _moveToShare() {
                 echo "both $d/ and share/$d/ exist!"
             else
                 echo "moving $out/$d to $out/share/$d"
-                mkdir $out/share
+                mkdir -p $out/share
                 mv $out/$d $out/share/
             fi
         fi
@@ -1,8 +1,13 @@
 package nix
 
 import (
+	"log"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/rule"
 )
@@ -11,14 +16,11 @@ import (
 type NixConfig struct {
 	// Enabled indicates whether Nix flake processing is enabled.
 	Enabled bool
-	// ExecutableMode controls how single-binary packages are handled.
-	// "auto" = detect and generate sh_binary
-	// "force" = always generate sh_binary
-	// "disable" = always generate nix_package
-	// ExecutableMode controls how single-binary packages are handled.
-	// "auto" = detect and generate sh_binary
-	// "force" = always generate sh_binary
-	// "disable" = always generate nix_package
+	// ExecutableMode controls how FlakeInfo.Executable is chosen from the
+	// output's NAR listing; see selectExecutable.
+	// "auto" = record the program only if it is unambiguous
+	// "force" = always record a best guess
+	// "disable" = never record an executable
 	ExecutableMode string
 	// NixpkgsCommit specifies the commit hash of nixpkgs to use.
 	NixpkgsCommit string
@@ -30,10 +32,51 @@ type NixConfig struct {
 	NixpkgsLabel string
 	// LockPath is the absolute path to the lockfile.
 	LockPath string
+	// Systems lists the Nix systems each flake is evaluated for. Empty
+	// evaluates .#default for the host only.
+	Systems []string
+	// LockLayout, if set, converts the lockfile to a layout: "single" or
+	// "sharded" (see cache.LockFileLayoutSharded). Unset keeps the layout
+	// the lockfile already has.
+	LockLayout string
+	// TrustedPublicKeys lists the "name:base64" ed25519 keys a narinfo must be
+	// signed with before it is written into the lockfile.
+	TrustedPublicKeys []string
+	// Substituters lists the binary cache URLs to query for narinfo.
+	Substituters []string
+	// SubstituterMirrors maps a substituter URL to mirrors serving the same
+	// NAR files, recorded in the lockfile as download fallbacks.
+	SubstituterMirrors map[string][]string
+	// NarInfoCacheDir is where narinfo lookups are cached between runs.
+	// Empty disables the disk cache.
+	NarInfoCacheDir string
+	// CrawlConcurrency bounds concurrent narinfo lookups and NAR listing
+	// fetches while crawling runtime closures.
+	CrawlConcurrency int
+	// CrawlTimeout bounds the crawls for each flake; a flake whose crawls
+	// do not finish in time keeps its previously locked entry. Zero means
+	// no limit.
+	CrawlTimeout time.Duration
+	// Credentials authenticate requests to substituters, from the netrc
+	// file and access tokens in nix.conf.
+	Credentials *cache.Credentials
+}
+
+// supportedSystems are the Nix systems the cache repository maps to Bazel
+// platform constraints.
+var supportedSystems = map[string]bool{
+	"x86_64-linux":   true,
+	"aarch64-linux":  true,
+	"x86_64-darwin":  true,
+	"aarch64-darwin": true,
 }
 
 func (c *NixConfig) Clone() *NixConfig {
 	newConfig := *c
+	newConfig.SubstituterMirrors = make(map[string][]string, len(c.SubstituterMirrors))
+	for k, v := range c.SubstituterMirrors {
+		newConfig.SubstituterMirrors[k] = v
+	}
 	return &newConfig
 }
 
@@ -57,11 +100,15 @@ func (l *nixLang) Configure(c *config.Config, rel string, f *rule.File) {
 		cfg = extra.(*NixConfig).Clone()
 	} else {
 		cfg = &NixConfig{
-			Enabled:        true,
-			ExecutableMode: "auto",
-			CacheName:      l.cacheName,
-			NixpkgsLabel:   l.nixpkgsLabel,
-			LockPath:       l.lockPath,
+			Enabled:           true,
+			ExecutableMode:    "auto",
+			CacheName:         l.cacheName,
+			NixpkgsLabel:      l.nixpkgsLabel,
+			LockPath:          l.lockPath,
+			TrustedPublicKeys: cache.DefaultTrustedPublicKeys,
+			Substituters:      []string{cache.DefaultCacheURL},
+			CrawlConcurrency:  defaultCrawlConcurrency,
+			CrawlTimeout:      defaultCrawlTimeout,
 		}
 		if cfg.CacheName == "" {
 			cfg.CacheName = "nix_cache"
@@ -69,6 +116,10 @@ func (l *nixLang) Configure(c *config.Config, rel string, f *rule.File) {
 		if cfg.LockPath == "" {
 			cfg.LockPath = filepath.Join(c.RepoRoot, "nix_deps", "nix.lock")
 		}
+		if dir, err := cache.DefaultNarInfoCacheDir(); err == nil {
+			cfg.NarInfoCacheDir = dir
+		}
+		applyNixConf(cfg, c.RepoRoot)
 	}
 	c.Exts[nixName] = cfg
 
@@ -79,13 +130,77 @@ func (l *nixLang) Configure(c *config.Config, rel string, f *rule.File) {
 			case "nix_flake":
 				cfg.Enabled = d.Value != "disable"
 			case "nix_executable":
-				cfg.ExecutableMode = d.Value
+				switch d.Value {
+				case "auto", "force", "disable":
+					cfg.ExecutableMode = d.Value
+				default:
+					log.Fatalf("invalid nix_executable %q: want auto, force or disable", d.Value)
+				}
 			case "nix_nixpkgs_commit":
 				cfg.NixpkgsCommit = d.Value
 			case "nix_nixpkgs_label":
 				cfg.NixpkgsLabel = d.Value
 			case "nix_cache_name":
 				cfg.CacheName = d.Value
+			case "nix_trusted_public_keys":
+				cfg.TrustedPublicKeys = strings.Fields(d.Value)
+			case "nix_substituters":
+				cfg.Substituters = nil
+				for _, url := range strings.Fields(d.Value) {
+					cfg.Substituters = append(cfg.Substituters, substituterURL(c.RepoRoot, url))
+				}
+			case "nix_substituter_mirrors":
+				fields := strings.Fields(d.Value)
+				if len(fields) > 0 {
+					if cfg.SubstituterMirrors == nil {
+						cfg.SubstituterMirrors = make(map[string][]string)
+					}
+					var mirrors []string
+					for _, url := range fields[1:] {
+						mirrors = append(mirrors, substituterURL(c.RepoRoot, url))
+					}
+					cfg.SubstituterMirrors[substituterURL(c.RepoRoot, fields[0])] = mirrors
+				}
+			case "nix_narinfo_cache":
+				switch {
+				case d.Value == "disable":
+					cfg.NarInfoCacheDir = ""
+				case filepath.IsAbs(d.Value):
+					cfg.NarInfoCacheDir = d.Value
+				default:
+					cfg.NarInfoCacheDir = filepath.Join(c.RepoRoot, d.Value)
+				}
+			case "nix_crawl_concurrency":
+				n, err := strconv.Atoi(d.Value)
+				if err != nil || n <= 0 {
+					log.Fatalf("invalid nix_crawl_concurrency %q: want a positive integer", d.Value)
+				}
+				cfg.CrawlConcurrency = n
+			case "nix_crawl_timeout":
+				if d.Value == "none" {
+					cfg.CrawlTimeout = 0
+					break
+				}
+				timeout, err := time.ParseDuration(d.Value)
+				if err != nil || timeout <= 0 {
+					log.Fatalf("invalid nix_crawl_timeout %q: want a positive duration such as 5m, or none", d.Value)
+				}
+				cfg.CrawlTimeout = timeout
+			case "nix_systems":
+				cfg.Systems = nil
+				for _, system := range strings.Fields(d.Value) {
+					if !supportedSystems[system] {
+						log.Fatalf("invalid nix_systems entry %q: want one of x86_64-linux, aarch64-linux, x86_64-darwin or aarch64-darwin", system)
+					}
+					cfg.Systems = append(cfg.Systems, system)
+				}
+			case "nix_lockfile_layout":
+				switch d.Value {
+				case "single", cache.LockFileLayoutSharded:
+					cfg.LockLayout = d.Value
+				default:
+					log.Fatalf("invalid nix_lockfile_layout %q: want single or sharded", d.Value)
+				}
 			case "nix_lockfile":
 				if filepath.IsAbs(d.Value) {
 					cfg.LockPath = d.Value
@@ -96,3 +211,42 @@ func (l *nixLang) Configure(c *config.Config, rel string, f *rule.File) {
 		}
 	}
 }
+
+// substituterURL resolves a binary cache given in a directive. URLs are
+// kept as-is; directories are file:// caches, relative to the repo root.
+func substituterURL(repoRoot, value string) string {
+	if strings.Contains(value, "://") {
+		return strings.TrimSuffix(value, "/")
+	}
+	if !filepath.IsAbs(value) {
+		value = filepath.Join(repoRoot, value)
+	}
+	return cache.LocalCacheURL(value)
+}
+
+// applyNixConf takes the default substituters, trusted keys and credentials
+// from the user's nix.conf, as nix itself would use them.
+func applyNixConf(cfg *NixConfig, repoRoot string) {
+	conf, err := cache.LoadNixConf()
+	if err != nil {
+		log.Fatalf("failed to read nix.conf: %v", err)
+	}
+	creds, err := conf.Credentials()
+	if err != nil {
+		log.Fatalf("failed to read nix.conf credentials: %v", err)
+	}
+	cfg.Credentials = creds
+	cfg.TrustedPublicKeys = conf.TrustedPublicKeys
+
+	var subs []string
+	for _, url := range conf.Substituters {
+		if !cache.IsSupportedCacheURL(url) {
+			log.Printf("Warning: ignoring unsupported substituter %s from nix.conf", url)
+			continue
+		}
+		subs = append(subs, substituterURL(repoRoot, url))
+	}
+	if len(subs) > 0 {
+		cfg.Substituters = subs
+	}
+}
@@ -0,0 +1,202 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+// defaultCrawlConcurrency bounds in-flight narinfo lookups and NAR listing
+// fetches per resolver.
+const defaultCrawlConcurrency = 16
+
+// defaultCrawlTimeout bounds the crawls and listing fetches for one flake.
+const defaultCrawlTimeout = 10 * time.Minute
+
+// closureCrawler resolves runtime closures with a bounded pool of lookups.
+// Every store path is looked up at most once per Gazelle run, no matter how
+// many flakes reference it, so crawls of different flakes share work.
+type closureCrawler struct {
+	res *storeResolver
+	sem chan struct{}
+
+	mu    sync.Mutex
+	nodes map[string]*crawlNode
+}
+
+// crawlNode is the pending or finished lookup of one store path.
+type crawlNode struct {
+	done chan struct{}
+	info *cache.NarInfo
+	// err is set if the lookup failed. Only permanent failures, such as
+	// no substituter having the path or a trusted narinfo for it, stay
+	// memoized; nodes that failed transiently are forgotten so that later
+	// crawls look again.
+	err error
+}
+
+// errNotCached is the error of looking up a path that no substituter has.
+var errNotCached = errors.New("not in any substituter")
+
+func newClosureCrawler(res *storeResolver, concurrency int) *closureCrawler {
+	if concurrency <= 0 {
+		concurrency = defaultCrawlConcurrency
+	}
+	return &closureCrawler{
+		res:   res,
+		sem:   make(chan struct{}, concurrency),
+		nodes: make(map[string]*crawlNode),
+	}
+}
+
+// acquire takes a slot in the pool, or fails once ctx is done.
+func (c *closureCrawler) acquire(ctx context.Context) error {
+	select {
+	case c.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *closureCrawler) release() { <-c.sem }
+
+// visit starts looking up storePath within ctx unless a lookup is already
+// in flight or done, and returns its node.
+func (c *closureCrawler) visit(ctx context.Context, storePath string) *crawlNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n, ok := c.nodes[storePath]; ok {
+		return n
+	}
+	n := &crawlNode{done: make(chan struct{})}
+	c.nodes[storePath] = n
+
+	go func() {
+		defer close(n.done)
+		info, err := c.lookup(ctx, storePath)
+		switch {
+		case err != nil:
+			n.err = fmt.Errorf("looking up %s: %w", storePath, err)
+			if cache.IsTransient(err) || ctx.Err() != nil {
+				c.forget(storePath, n)
+			}
+		case info == nil:
+			n.err = fmt.Errorf("%s is %w", storePath, errNotCached)
+		default:
+			n.info = info
+		}
+	}()
+	return n
+}
+
+func (c *closureCrawler) lookup(ctx context.Context, storePath string) (*cache.NarInfo, error) {
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	return c.res.client.LookupNarInfoContext(ctx, cache.StoreHash(storePath))
+}
+
+// forget drops n, if it is still storePath's node, so the next visit looks
+// the path up again.
+func (c *closureCrawler) forget(storePath string, n *crawlNode) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.nodes[storePath] == n {
+		delete(c.nodes, storePath)
+	}
+}
+
+// wait returns the finished node for storePath. A node is shared by every
+// crawl that reaches the path, so if it was started by a crawl whose
+// context has since ended, the path is looked up again within ctx.
+func (c *closureCrawler) wait(ctx context.Context, storePath string, n *crawlNode) (*crawlNode, error) {
+	for {
+		select {
+		case <-n.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if n.err == nil || !isContextError(n.err) || ctx.Err() != nil {
+			return n, nil
+		}
+		n = c.visit(ctx, storePath)
+	}
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// closure returns the runtime closure of root in breadth-first order along
+// with the narinfo of every member. All paths at the same depth are
+// looked up concurrently. Only narinfo signed by a trusted key is returned,
+// from the first substituter that has one. Any failed lookup, including an
+// uncached reference, a transient failure or running past ctx's deadline,
+// aborts the crawl, since a closure with holes would be locked as if it were
+// complete.
+//
+// If root itself is in no substituter, e.g. because it was only built
+// locally, its references are unknown, and the closure is root alone with
+// no narinfo. The module extension skips such a path.
+func (c *closureCrawler) closure(ctx context.Context, root string) ([]string, []*cache.NarInfo, error) {
+	level := []string{root}
+	visited := map[string]bool{root: true}
+	var closure []string
+	var infos []*cache.NarInfo
+
+	for len(level) > 0 {
+		nodes := make([]*crawlNode, len(level))
+		for i, p := range level {
+			nodes[i] = c.visit(ctx, p)
+		}
+
+		var next []string
+		for i, p := range level {
+			n, err := c.wait(ctx, p, nodes[i])
+			if err != nil {
+				return nil, nil, err
+			}
+			if n.err != nil {
+				if p == root && errors.Is(n.err, errNotCached) {
+					log.Printf("Warning: %v; locking it without its runtime closure", n.err)
+					return []string{root}, nil, nil
+				}
+				return nil, nil, n.err
+			}
+			closure = append(closure, p)
+			infos = append(infos, n.info)
+
+			// info.References are typically basenames in NarInfo from cache
+			for _, ref := range n.info.References {
+				fullRef := ref
+				if len(ref) > 0 && ref[0] != '/' {
+					fullRef = "/nix/store/" + ref
+				}
+				if !visited[fullRef] {
+					visited[fullRef] = true
+					next = append(next, fullRef)
+				}
+			}
+		}
+		level = next
+	}
+	return closure, infos, nil
+}
+
+// listing fetches the NAR listing of info, sharing the lookups' pool so
+// that flakes finishing their crawls together do not all fetch at once.
+func (c *closureCrawler) listing(ctx context.Context, info *cache.NarInfo) (*cache.NarListing, error) {
+	if err := c.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer c.release()
+	return c.res.client.NarListingContext(ctx, info)
+}
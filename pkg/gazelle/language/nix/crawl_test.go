@@ -0,0 +1,218 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+const (
+	hashA = "i3zw7h6pg3n9r5i63iyqxrapa70i4v5w"
+	hashB = "kywwgk85nl83mpf10av3bvm2khdlq5ib"
+	hashC = "hlcdbvwjlzjd2x86fxghzj1gpzplccqw"
+	hashM = "j193mfi0f921y0kfs8vjc1znnr45ispv"
+
+	pathA = "/nix/store/" + hashA + "-a"
+	pathB = "/nix/store/" + hashB + "-b"
+	pathC = "/nix/store/" + hashC + "-c"
+	pathM = "/nix/store/" + hashM + "-missing"
+)
+
+// testSubstituter serves narinfo for a fixed graph of store paths and
+// counts the requests for each. Handlers can be overridden per hash.
+type testSubstituter struct {
+	mu       sync.Mutex
+	refs     map[string][]string // store path -> referenced store paths
+	requests map[string]int
+	handlers map[string]http.HandlerFunc
+}
+
+func newTestSubstituter(t *testing.T, refs map[string][]string) (*testSubstituter, *closureCrawler) {
+	t.Helper()
+	s := &testSubstituter{refs: refs, requests: make(map[string]int), handlers: make(map[string]http.HandlerFunc)}
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	client := cache.New(srv.URL)
+	client.MaxRetries = 0
+	res := &storeResolver{client: client}
+	res.crawler = newClosureCrawler(res, 4)
+	return s, res.crawler
+}
+
+func (s *testSubstituter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hash, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".narinfo")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	s.mu.Lock()
+	s.requests[hash]++
+	handler := s.handlers[hash]
+	s.mu.Unlock()
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+	for p, refs := range s.refs {
+		if cache.StoreHash(p) != hash {
+			continue
+		}
+		var names []string
+		for _, ref := range refs {
+			names = append(names, cache.StoreBaseName(ref))
+		}
+		fmt.Fprintf(w, "StorePath: %s\nURL: nar/%s.nar\nCompression: none\nReferences: %s\n", p, hash, strings.Join(names, " "))
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (s *testSubstituter) count(hash string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[hash]
+}
+
+func (s *testSubstituter) handle(hash string, h http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[hash] = h
+}
+
+func TestClosureDeduplicatesLookups(t *testing.T) {
+	s, c := newTestSubstituter(t, map[string][]string{
+		pathA: {pathA, pathB, pathC},
+		pathB: {pathC},
+		pathC: nil,
+	})
+
+	var wg sync.WaitGroup
+	for _, root := range []string{pathA, pathA, pathB, pathC} {
+		wg.Add(1)
+		go func(root string) {
+			defer wg.Done()
+			if _, _, err := c.closure(context.Background(), root); err != nil {
+				t.Errorf("closure(%s): %v", root, err)
+			}
+		}(root)
+	}
+	wg.Wait()
+
+	closure, infos, err := c.closure(context.Background(), pathA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{pathA, pathB, pathC}; !reflect.DeepEqual(closure, want) {
+		t.Errorf("closure = %v; want %v", closure, want)
+	}
+	if len(infos) != 3 {
+		t.Errorf("got %d narinfos; want 3", len(infos))
+	}
+	for _, hash := range []string{hashA, hashB, hashC} {
+		if n := s.count(hash); n != 1 {
+			t.Errorf("%s was requested %d times; want 1", hash, n)
+		}
+	}
+}
+
+func TestClosureRetriesTransientFailures(t *testing.T) {
+	s, c := newTestSubstituter(t, map[string][]string{
+		pathA: {pathB},
+		pathB: nil,
+	})
+	s.handle(hashB, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	})
+
+	if _, _, err := c.closure(context.Background(), pathA); !cache.IsTransient(err) {
+		t.Fatalf("closure with a failing path = %v; want a transient error", err)
+	}
+
+	// The failure is not memoized: the next crawl looks the path up again.
+	s.handle(hashB, nil)
+	closure, _, err := c.closure(context.Background(), pathA)
+	if err != nil {
+		t.Fatalf("closure after the failure cleared: %v", err)
+	}
+	if want := []string{pathA, pathB}; !reflect.DeepEqual(closure, want) {
+		t.Errorf("closure = %v; want %v", closure, want)
+	}
+	if n := s.count(hashB); n != 2 {
+		t.Errorf("%s was requested %d times; want 2", hashB, n)
+	}
+	if n := s.count(hashA); n != 1 {
+		t.Errorf("%s was requested %d times; want 1", hashA, n)
+	}
+}
+
+func TestClosureSharedNodeOutlivesCanceledCrawl(t *testing.T) {
+	s, c := newTestSubstituter(t, map[string][]string{pathB: nil})
+	started := make(chan struct{})
+	var once sync.Once
+	s.handle(hashB, func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(started) })
+		<-r.Context().Done()
+	})
+
+	// The first crawl's lookup hangs until its context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	n := c.visit(ctx, pathB)
+	<-started
+
+	// A second crawl waiting on the same node must not inherit the
+	// cancellation, but look the path up again within its own context.
+	type result struct {
+		n   *crawlNode
+		err error
+	}
+	done := make(chan result)
+	go func() {
+		n, err := c.wait(context.Background(), pathB, n)
+		done <- result{n, err}
+	}()
+	s.handle(hashB, nil)
+	cancel()
+
+	r := <-done
+	if r.err != nil || r.n.err != nil || r.n.info == nil {
+		t.Fatalf("wait after the other crawl was canceled = %+v, %v", r.n, r.err)
+	}
+	// Within the canceled context, the failure is either the wait's own
+	// or the node's.
+	if n, err := c.wait(ctx, pathB, n); err == nil && !errors.Is(n.err, context.Canceled) {
+		t.Errorf("wait within the canceled context = %+v; want context.Canceled", n)
+	} else if err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("wait within the canceled context = %v; want context.Canceled", err)
+	}
+}
+
+func TestClosureMissAborts(t *testing.T) {
+	_, c := newTestSubstituter(t, map[string][]string{
+		pathA: {pathB, pathM},
+		pathB: nil,
+	})
+	_, _, err := c.closure(context.Background(), pathA)
+	if err == nil || !strings.Contains(err.Error(), pathM) {
+		t.Errorf("closure with an uncached reference = %v; want an error naming %s", err, pathM)
+	}
+}
+
+func TestClosureOfUncachedRoot(t *testing.T) {
+	_, c := newTestSubstituter(t, nil)
+	closure, infos, err := c.closure(context.Background(), pathM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{pathM}; !reflect.DeepEqual(closure, want) || len(infos) != 0 {
+		t.Errorf("closure = %v, %d narinfos; want %v and none", closure, len(infos), want)
+	}
+}
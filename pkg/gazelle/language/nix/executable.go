@@ -0,0 +1,63 @@
+package nix
+
+import (
+	"log"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+// selectExecutable picks a flake output's program as a path relative to
+// the output, e.g. "bin/hello", according to the nix_executable mode:
+//
+//   - "auto" returns bin/<mainProgram>, the only program in bin/, or
+//     bin/<pname>, in that order, and nothing if none applies.
+//   - "force" falls back further to the first program in bin/, or to a
+//     bin/<mainProgram> or bin/<pname> the listing cannot confirm.
+//   - "disable" never returns an executable.
+//
+// listing may be nil when the output or its listing is not in a cache; then
+// only an explicit meta.mainProgram is trusted in "auto" mode.
+func selectExecutable(mode string, listing *cache.NarListing, mainProgram, pname string) string {
+	if mode == "disable" {
+		return ""
+	}
+
+	if listing == nil {
+		switch {
+		case mainProgram != "":
+			return "bin/" + mainProgram
+		case mode == "force" && pname != "":
+			return "bin/" + pname
+		}
+		return ""
+	}
+
+	bins := listing.Executables("bin")
+	has := func(name string) bool {
+		for _, b := range bins {
+			if b == name {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case mainProgram != "" && has(mainProgram):
+		return "bin/" + mainProgram
+	case len(bins) == 1:
+		return "bin/" + bins[0]
+	case pname != "" && has(pname):
+		return "bin/" + pname
+	case mode != "force":
+		return ""
+	case len(bins) > 0:
+		log.Printf("Warning: %d programs in bin/, using %s", len(bins), bins[0])
+		return "bin/" + bins[0]
+	case mainProgram != "":
+		return "bin/" + mainProgram
+	case pname != "":
+		return "bin/" + pname
+	}
+	log.Printf("Warning: nix_executable force: no program found")
+	return ""
+}
@@ -0,0 +1,51 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+func binListing(names ...string) *cache.NarListing {
+	bin := &cache.ListingEntry{Type: "directory", Entries: map[string]*cache.ListingEntry{
+		"README": {Type: "regular"},
+	}}
+	for _, name := range names {
+		bin.Entries[name] = &cache.ListingEntry{Type: "regular", Executable: true}
+	}
+	return &cache.NarListing{Version: 1, Root: &cache.ListingEntry{
+		Type:    "directory",
+		Entries: map[string]*cache.ListingEntry{"bin": bin},
+	}}
+}
+
+func TestSelectExecutable(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		mode        string
+		listing     *cache.NarListing
+		mainProgram string
+		pname       string
+		want        string
+	}{
+		{"disabled", "disable", binListing("hello"), "hello", "hello", ""},
+		{"no listing, mainProgram", "auto", nil, "hello", "other", "bin/hello"},
+		{"no listing, pname", "auto", nil, "", "hello", ""},
+		{"no listing, forced pname", "force", nil, "", "hello", "bin/hello"},
+		{"mainProgram listed", "auto", binListing("hello", "hello-wrapped"), "hello", "", "bin/hello"},
+		{"mainProgram missing", "auto", binListing("hi", "hey"), "hello", "", ""},
+		{"single executable", "auto", binListing("hi"), "hello", "hello", "bin/hi"},
+		{"pname listed", "auto", binListing("git", "git-shell"), "", "git", "bin/git"},
+		{"ambiguous", "auto", binListing("a", "b"), "", "c", ""},
+		{"forced ambiguous", "force", binListing("b", "a"), "", "c", "bin/a"},
+		{"no executables", "auto", binListing(), "hello", "hello", ""},
+		{"forced without executables", "force", binListing(), "", "hello", "bin/hello"},
+		{"forced without names", "force", binListing(), "", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := selectExecutable(tc.mode, tc.listing, tc.mainProgram, tc.pname); got != tc.want {
+				t.Errorf("selectExecutable(%q, %q, %q) = %q; want %q", tc.mode, tc.mainProgram, tc.pname, got, tc.want)
+			}
+		})
+	}
+}
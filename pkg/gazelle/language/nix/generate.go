@@ -1,19 +1,22 @@
 package nix
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
 	"github.com/bazelbuild/bazel-gazelle/config"
 	"github.com/bazelbuild/bazel-gazelle/language"
 	"github.com/bazelbuild/bazel-gazelle/rule"
+	bzl "github.com/bazelbuild/buildtools/build"
 	"github.com/bazelbuild/rules_go/go/runfiles"
 )
 
@@ -194,7 +197,7 @@ type GenerateArgs = language.GenerateArgs
 // GenerateResult contains the result of rule generation.
 type GenerateResult = language.GenerateResult
 
-func (l *nixLang) getLockFile(path string) *cache.LockFile {
+func (l *nixLang) getLockFile(path, repoRoot string) *cache.LockFile {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -206,6 +209,10 @@ func (l *nixLang) getLockFile(path string) *cache.LockFile {
 	if err != nil {
 		log.Fatalf("failed to load lockfile %s: %v", path, err)
 	}
+	if lf.MigratedFrom != 0 {
+		log.Printf("Upgraded lockfile %s from schema version %d to %d", path, lf.MigratedFrom, lf.Version)
+	}
+	lf.Root = repoRoot
 	l.lockFiles[path] = lf
 	return lf
 }
@@ -224,21 +231,23 @@ func (l *nixLang) GenerateRules(args GenerateArgs) GenerateResult {
 		return GenerateResult{}
 	}
 
-	// deps := inputsToDeps(inputs, args.Rel)
-	var deps []string
+	res := l.resolverFor(cfg)
 
 	// Load the correct lockfile
-	lf := l.getLockFile(cfg.LockPath)
+	lf := l.getLockFile(cfg.LockPath, args.Config.RepoRoot)
 
-	// Update lockfile with NixpkgsCommit if specified
-	if cfg.NixpkgsCommit != "" && lf != nil {
-		l.mu.Lock()
-		if lf.NixpkgsCommit != cfg.NixpkgsCommit {
-			lf.NixpkgsCommit = cfg.NixpkgsCommit
-			lf.Save(cfg.LockPath)
-		}
-		l.mu.Unlock()
+	// Update lockfile with NixpkgsCommit and layout if specified
+	l.mu.Lock()
+	if cfg.NixpkgsCommit != "" {
+		lf.NixpkgsCommit = cfg.NixpkgsCommit
+	}
+	switch cfg.LockLayout {
+	case "single":
+		lf.Layout = ""
+	case cache.LockFileLayoutSharded:
+		lf.Layout = cache.LockFileLayoutSharded
 	}
+	l.mu.Unlock()
 
 	// Resolve derivation to get output hash
 	nixpkgsOverride := ""
@@ -252,54 +261,43 @@ func (l *nixLang) GenerateRules(args GenerateArgs) GenerateResult {
 		nixpkgsOverride = "github:NixOS/nixpkgs/" + cfg.NixpkgsCommit
 	}
 
-	storePath, drvHash, env, err := resolveFlakeOutput(args.Config, args.Dir, nixpkgsOverride)
-	if err != nil {
-		log.Printf("Warning: failed to resolve derivation for %s: %v", args.Dir, err)
-	}
-
-	// For mkShell flakes, extract dependencies from PATH in env
-	// instead of from the shell's own output store path
 	cacheName := cfg.CacheName
 	if cacheName == "" {
 		cacheName = "nix_cache"
 	}
 
-	// Extract dependencies from ALL env vars by scanning for /nix/store paths
-	// This captures PATH, JAVA_HOME, LD_LIBRARY_PATH, etc.
-	storePathRe := regexp.MustCompile(`/nix/store/([a-z0-9]{32}-[^/:]+)`)
-	seenPaths := make(map[string]bool)
-
-	for _, value := range env {
-		matches := storePathRe.FindAllStringSubmatch(value, -1)
-		for _, m := range matches {
-			storePath := "/nix/store/" + m[1]
-			if seenPaths[storePath] {
-				continue
-			}
-			seenPaths[storePath] = true
-
-			// Look up in cache to add as dependency
-			hash := cache.StoreHash(storePath)
-			info, err := l.cacheClient.LookupNarInfo(hash)
-			if err == nil && info != nil {
-				depLabel := fmt.Sprintf("@%s//:s_%s", cacheName, hash)
-				deps = append(deps, depLabel)
-				// Also crawl this dependency's closure
-				l.crawlClosure(lf, storePath)
-			}
-		}
-	}
-
-	// Update lockfile with flake info (without the shell's own store path as a required dep)
 	label := "//" + args.Rel + ":default"
 	if args.Rel == "" {
 		label = "//:default"
 	}
-	l.updateLockfile(lf, label, storePath, drvHash, deps, "", env)
 
-	// Save the correct lockfile
-	if err := lf.Save(cfg.LockPath); err != nil {
-		log.Fatalf("failed to save lockfile %s: %v", cfg.LockPath, err)
+	// Without nix_systems the flake is evaluated for the host only.
+	systems := cfg.Systems
+	if len(systems) == 0 {
+		systems = []string{""}
+	} else {
+		l.mu.Lock()
+		lf.RetainFlakeSystems(label, systems)
+		l.mu.Unlock()
+	}
+
+	outputs := make([]flakeOutput, len(systems))
+	systemDeps := make([][]string, len(systems))
+	for i, system := range systems {
+		out, err := resolveFlakeOutput(args.Config, args.Dir, nixpkgsOverride, system)
+		if err != nil {
+			log.Printf("Warning: failed to resolve derivation for %s%s: %v", args.Dir, systemSuffix(system), err)
+		}
+		deps, depPaths := storePathDeps(res, cacheName, out.Env)
+		outputs[i], systemDeps[i] = out, deps
+
+		// Closures only feed the lockfile, not the generated rules, so
+		// crawl them in the background. DoneGeneratingRules waits for them.
+		l.crawls.Add(1)
+		go func(system string) {
+			defer l.crawls.Done()
+			l.updateLockfile(lf, label, system, out, cfg.ExecutableMode, cfg.CrawlTimeout, deps, depPaths, res)
+		}(system)
 	}
 
 	var rules []*rule.Rule
@@ -308,14 +306,36 @@ func (l *nixLang) GenerateRules(args GenerateArgs) GenerateResult {
 	// Users define their own nix_flake_run_under targets
 	pkgRule := rule.NewRule("nix_package", "default")
 	pkgRule.SetAttr("flake", "flake.nix")
-	pkgRule.SetAttr("output_path", storePath)
-	pkgRule.SetAttr("visibility", []string{"//visibility:public"})
-	if len(deps) > 0 {
+	if len(cfg.Systems) == 0 {
+		out, deps := outputs[0], systemDeps[0]
+		pkgRule.SetAttr("output_path", out.StorePath)
+		if len(deps) > 0 {
+			pkgRule.SetAttr("deps", deps)
+		}
+		if len(out.Env) > 0 {
+			pkgRule.SetAttr("env", out.Env)
+		}
+	} else {
+		// One branch per system, keyed by the config_settings the
+		// module extension generates in the cache repository.
+		outputPaths := make(selectValue)
+		envs := make(selectValue)
+		deps := make(rule.SelectStringListValue)
+		for i, system := range systems {
+			key := systemConfigSetting(cacheName, system)
+			outputPaths[key] = outputs[i].StorePath
+			deps[key] = append([]string{}, systemDeps[i]...)
+			env := outputs[i].Env
+			if env == nil {
+				env = map[string]string{}
+			}
+			envs[key] = env
+		}
+		pkgRule.SetAttr("output_path", outputPaths)
 		pkgRule.SetAttr("deps", deps)
+		pkgRule.SetAttr("env", envs)
 	}
-	if len(env) > 0 {
-		pkgRule.SetAttr("env", env)
-	}
+	pkgRule.SetAttr("visibility", []string{"//visibility:public"})
 	rules = append(rules, pkgRule)
 
 	imports := make([]interface{}, len(rules))
@@ -329,34 +349,161 @@ func (l *nixLang) GenerateRules(args GenerateArgs) GenerateResult {
 	}
 }
 
-// updateLockfile queries the cache and updates the lockfile.
-func (l *nixLang) updateLockfile(lf *cache.LockFile, label string, storePath string, drvHash string, deps []string, executable string, env map[string]string) {
+// storePathDeps returns the cached store paths mentioned in a flake's
+// environment and their @<cacheName> labels. For mkShell flakes these are
+// the real dependencies, rather than the shell's own output store path.
+// All env vars are scanned, capturing PATH, JAVA_HOME, LD_LIBRARY_PATH, etc.
+func storePathDeps(res *storeResolver, cacheName string, env map[string]string) (deps, depPaths []string) {
+	seenPaths := make(map[string]bool)
+	for _, value := range env {
+		for _, p := range cache.FindStorePaths(value) {
+			storePath := p.String()
+			if seenPaths[storePath] {
+				continue
+			}
+			seenPaths[storePath] = true
+
+			// Check the cache to add as dependency; the closure crawl
+			// fetches and verifies the narinfo itself.
+			cached, err := res.client.IsCached(p.Hash)
+			if err != nil {
+				log.Printf("Warning: error looking up %s: %v", storePath, err)
+				continue
+			}
+			if cached {
+				deps = append(deps, fmt.Sprintf("@%s//:s_%s", cacheName, p.Hash))
+				depPaths = append(depPaths, storePath)
+			}
+		}
+	}
+	// Map iteration order is random; keep generated deps stable.
+	sort.Strings(deps)
+	return deps, depPaths
+}
+
+// systemConfigSetting returns the config_setting the cache repository
+// defines for a Nix system.
+func systemConfigSetting(cacheName, system string) string {
+	return fmt.Sprintf("@%s//:system_%s", cacheName, system)
+}
+
+// systemSuffix describes system in messages; the host is left implicit.
+func systemSuffix(system string) string {
+	if system == "" {
+		return ""
+	}
+	return " (" + system + ")"
+}
+
+// selectValue renders as a select() over arbitrary attribute values.
+type selectValue map[string]interface{}
+
+func (s selectValue) BzlExpr() bzl.Expr {
+	return &bzl.CallExpr{
+		X:    &bzl.Ident{Name: "select"},
+		List: []bzl.Expr{rule.ExprFromValue(map[string]interface{}(s))},
+	}
+}
+
+// updateLockfile crawls the closures of a flake's output and of the store
+// paths it depends on, picks the output's executable, then records them in
+// the lockfile under system ("" for a host-only flake). Crawling is bounded
+// by crawlTimeout, if positive. It may run concurrently with other flakes;
+// l.mu is only held while the lockfile is modified.
+func (l *nixLang) updateLockfile(lf *cache.LockFile, label, system string, out flakeOutput, executableMode string, crawlTimeout time.Duration, deps []string, depPaths []string, res *storeResolver) {
 	if lf == nil {
 		return
 	}
+	if out.StorePath == "" {
+		// The flake failed to evaluate; keep whatever was locked before
+		// rather than recording an entry without an output.
+		return
+	}
 
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	ctx := context.Background()
+	if crawlTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, crawlTimeout)
+		defer cancel()
+	}
+
+	// A closure that cannot be crawled in full fails the whole update, so
+	// that the flake keeps what was locked before rather than an entry
+	// missing store paths.
+	var infos []*cache.NarInfo
+	for _, p := range depPaths {
+		_, depInfos, err := res.crawler.closure(ctx, p)
+		if err != nil {
+			log.Printf("Warning: not updating %s%s: failed to resolve closure for %s: %v", label, systemSuffix(system), p, err)
+			return
+		}
+		infos = append(infos, depInfos...)
+	}
 
 	// Query closure
 	closure := []string{}
+	var outInfo *cache.NarInfo
 	// Only query closure if we have a valid store path and it's not a dummy
-	if storePath != "" && strings.HasPrefix(storePath, "/nix/store") {
-		c, err := l.crawlClosure(lf, storePath)
+	if strings.HasPrefix(out.StorePath, "/nix/store") {
+		c, outInfos, err := res.crawler.closure(ctx, out.StorePath)
 		if err != nil {
-			log.Printf("Warning: failed to resolve closure for %s: %v", storePath, err)
-			// Fallback: just add the store path itself if possible?
-			// But AddFlake requires closure list.
-		} else {
-			closure = c
+			log.Printf("Warning: not updating %s%s: failed to resolve closure for %s: %v", label, systemSuffix(system), out.StorePath, err)
+			return
+		}
+		closure = c
+		infos = append(infos, outInfos...)
+		if len(outInfos) > 0 && outInfos[0].StorePath == out.StorePath {
+			outInfo = outInfos[0]
+		}
+	}
+
+	var listing *cache.NarListing
+	if outInfo != nil && executableMode != "disable" {
+		var err error
+		if listing, err = res.crawler.listing(ctx, outInfo); err != nil {
+			log.Printf("Warning: failed to fetch NAR listing for %s: %v", out.StorePath, err)
+		}
+	}
+	executable := selectExecutable(executableMode, listing, out.MainProgram, out.PName)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, info := range infos {
+		if err := lf.AddStorePath(info); err != nil {
+			log.Printf("Warning: not updating %s%s: %v", label, systemSuffix(system), err)
+			return
 		}
 	}
+	if system == "" {
+		lf.AddFlake(label, out.DrvHash, out.StorePath, executable, out.Env, deps, closure)
+		return
+	}
+	lf.AddFlakeSystem(label, system, cache.SystemOutput{
+		DrvHash:         out.DrvHash,
+		Deps:            deps,
+		OutputStorePath: out.StorePath,
+		Executable:      executable,
+		Env:             out.Env,
+		Closure:         closure,
+	})
+}
 
-	lf.AddFlake(label, drvHash, storePath, executable, env, deps, closure)
+// flakeOutput describes the default package of a flake.
+type flakeOutput struct {
+	StorePath string
+	DrvHash   string
+	Env       map[string]string
+	// MainProgram is meta.mainProgram, and PName the derivation's pname;
+	// both name candidates for the executable in bin/.
+	MainProgram string
+	PName       string
 }
 
-// resolveFlakeOutput runs 'nix show-derivation' and 'nix print-dev-env'.
-func resolveFlakeOutput(c *config.Config, dir, nixpkgsOverride string) (string, string, map[string]string, error) {
+// resolveFlakeOutput runs 'nix derivation show' and 'nix print-dev-env', and
+// evaluates meta.mainProgram unless executable detection is disabled. An
+// empty system evaluates .#default for the host; otherwise the flake's
+// packages.<system>.default is used.
+func resolveFlakeOutput(c *config.Config, dir, nixpkgsOverride, system string) (flakeOutput, error) {
 	runNix := func(args ...string) ([]byte, error) {
 		// Heuristic to finding 'nix' or 'nix-portable'
 		// If we use 'findNixPortable', it returns a path found in runfiles or PATH.
@@ -395,33 +542,54 @@ func resolveFlakeOutput(c *config.Config, dir, nixpkgsOverride string) (string,
 		extraArgs = append(extraArgs, "--override-input", "nixpkgs", nixpkgsOverride)
 	}
 
+	attr := ".#default"
+	if system != "" {
+		attr = ".#packages." + system + ".default"
+	}
+
 	// 1. Show Derivation
 	args1 := append([]string{"derivation", "show"}, extraArgs...)
-	args1 = append(args1, ".#default")
+	args1 = append(args1, attr)
 
 	drvOut, err := runNix(args1...)
 	if err != nil {
-		return "", "", nil, err
+		return flakeOutput{}, err
 	}
 
-	var drvData map[string]interface{}
-	if err := json.Unmarshal(drvOut, &drvData); err != nil {
-		return "", "", nil, fmt.Errorf("failed to parse derivation: %w", err)
+	drvs, err := cache.ParseDerivationsJSON(drvOut)
+	if err != nil {
+		return flakeOutput{}, err
+	}
+	if len(drvs) != 1 {
+		return flakeOutput{}, fmt.Errorf("expected one derivation for %s, got %d", attr, len(drvs))
 	}
 
-	var drvHash, storePath string
-	for k, v := range drvData {
-		drvHash = k
-		outputs := v.(map[string]interface{})["outputs"].(map[string]interface{})
-		if out, ok := outputs["out"]; ok {
-			storePath = out.(map[string]interface{})["path"].(string)
+	var result flakeOutput
+	var drvEnv map[string]string
+	for drvPath, drv := range drvs {
+		out, ok := drv.Outputs["out"]
+		if !ok || out.Path == "" {
+			return flakeOutput{}, fmt.Errorf("%s has no out output with a known path", drvPath)
+		}
+		// Lockfiles record the bare hash of the derivation's store path.
+		result.DrvHash = cache.StoreHash(drvPath)
+		result.StorePath = out.Path
+		result.PName = drv.Env["pname"]
+		drvEnv = drv.Env
+	}
+
+	if GetNixConfig(c).ExecutableMode != "disable" {
+		args := append([]string{"eval", "--raw"}, extraArgs...)
+		args = append(args, attr+".meta.mainProgram")
+		// Most packages do not set mainProgram, so failure is expected.
+		if out, err := runNix(args...); err == nil {
+			result.MainProgram = strings.TrimSpace(string(out))
 		}
-		break
 	}
 
 	// 2. Print Dev Env
 	args2 := append([]string{"print-dev-env", "--json"}, extraArgs...)
-	args2 = append(args2, ".#default")
+	args2 = append(args2, attr)
 
 	envOut, err := runNix(args2...)
 	envMap := make(map[string]string)
@@ -443,11 +611,17 @@ func resolveFlakeOutput(c *config.Config, dir, nixpkgsOverride string) (string,
 		} else {
 			log.Printf("Warning: failed to unmarshal env output: %v", err)
 		}
+	} else if system != "" {
+		// Building the dev environment of another system usually needs a
+		// builder for it; the derivation's own environment names the same
+		// inputs.
+		envMap = drvEnv
 	} else {
 		log.Printf("Warning: failed to print-dev-env: %v", err)
 	}
 
-	return storePath, drvHash, envMap, nil
+	result.Env = envMap
+	return result, nil
 }
 
 func min(a, b int) int {
@@ -457,57 +631,6 @@ func min(a, b int) int {
 	return b
 }
 
-// crawlClosure recursively finds dependencies in the cache and populates StorePaths in lockfile.
-func (l *nixLang) crawlClosure(lf *cache.LockFile, rootPath string) ([]string, error) {
-	queue := []string{rootPath}
-	visited := make(map[string]bool)
-	var closure []string
-
-	for len(queue) > 0 {
-		p := queue[0]
-		queue = queue[1:]
-
-		if visited[p] {
-			continue
-		}
-		visited[p] = true
-		closure = append(closure, p)
-
-		// Lookup NarInfo
-		hash := cache.StoreHash(p)
-		info, err := l.cacheClient.LookupNarInfo(hash)
-		if err != nil {
-			log.Printf("Warning: error looking up %s: %v", p, err)
-			continue
-		}
-		if info == nil {
-			log.Printf("Warning: %s not found in cache", p)
-			// TODO: Handle uncached paths (e.g. local build required)
-			continue
-		}
-
-		// Add to LockFile
-		l.mu.Lock()
-		lf.AddStorePath(info)
-		l.mu.Unlock()
-
-		// Enqueue References
-		// info.References are typically basenames in NarInfo from cache
-		for _, ref := range info.References {
-			fullRef := ref
-			if len(ref) > 0 && ref[0] != '/' {
-				fullRef = "/nix/store/" + ref
-			}
-
-			// Avoid self-ref loop if listed
-			if fullRef != p && !visited[fullRef] {
-				queue = append(queue, fullRef)
-			}
-		}
-	}
-	return closure, nil
-}
-
 // findNixPortable locates the nix-portable binary.
 func findNixPortable(c *config.Config) string {
 	r, err := runfiles.New()
@@ -539,17 +662,3 @@ func findNixPortable(c *config.Config) string {
 	log.Printf("Warning: nix not found in runfiles or path")
 	return ""
 }
-
-// detectSingleBinary checks if the package produces a single executable.
-// This is a heuristic - in practice we'd query the derivation or NAR listing.
-func detectSingleBinary(c *config.Config, dir string) (bool, string) {
-	// TODO: Implement actual detection by querying cache or derivation output
-	// For now, use a simple heuristic based on package name
-	name := filepath.Base(dir)
-	knownSingleBinaries := map[string]bool{
-		"hello": true,
-		"curl":  true,
-		"jq":    true,
-	}
-	return knownSingleBinaries[name], name
-}
@@ -6,6 +6,10 @@ package nix
 
 import (
 	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
@@ -19,7 +23,8 @@ const nixName = "nix"
 // nixLang implements language.Language for Nix flakes.
 type nixLang struct {
 	mu           sync.Mutex
-	cacheClient  *cache.Cache
+	resolvers    map[string]*storeResolver // Keyed by substituter settings
+	crawls       sync.WaitGroup            // Background closure crawls
 	lockFiles    map[string]*cache.LockFile
 	lockPath     string
 	nixpkgsLabel string
@@ -27,11 +32,13 @@ type nixLang struct {
 	initialized  bool
 }
 
+var _ language.FinishableLanguage = (*nixLang)(nil)
+
 // NewLanguage returns a new Nix language extension for Gazelle.
 func NewLanguage() language.Language {
 	return &nixLang{
-		cacheClient: cache.New(""), // Use default cache URL
-		lockFiles:   make(map[string]*cache.LockFile),
+		resolvers: make(map[string]*storeResolver),
+		lockFiles: make(map[string]*cache.LockFile),
 	}
 }
 
@@ -84,6 +91,51 @@ func (*nixLang) KnownDirectives() []string {
 		"nix_nixpkgs_label",
 		"nix_cache_name",
 		"nix_lockfile",
+		"nix_lockfile_layout",     // # gazelle:nix_lockfile_layout single|sharded
+		"nix_trusted_public_keys", // # gazelle:nix_trusted_public_keys <name:base64> ...
+		"nix_substituters",        // # gazelle:nix_substituters <url|dir> ... (tried in /nix-cache-info priority order)
+		"nix_substituter_mirrors", // # gazelle:nix_substituter_mirrors <substituter-url> <mirror-url> ...
+		"nix_narinfo_cache",       // # gazelle:nix_narinfo_cache <dir>/disable
+		"nix_crawl_concurrency",   // # gazelle:nix_crawl_concurrency <n>
+		"nix_crawl_timeout",       // # gazelle:nix_crawl_timeout <duration>/none
+		"nix_systems",             // # gazelle:nix_systems <system> ...
+	}
+}
+
+// DoneGeneratingRules implements language.FinishableLanguage. It waits for
+// the closure crawls started by GenerateRules, prunes flakes that no longer
+// exist and store paths nothing needs, and saves every lockfile once. A
+// lockfile that cannot be saved, including one another run changed since
+// it was loaded, fails the run rather than leave it silently stale.
+func (l *nixLang) DoneGeneratingRules() {
+	l.crawls.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for path, lf := range l.lockFiles {
+		pruneLockFile(path, lf)
+		if err := lf.Save(path); err != nil {
+			log.Fatalf("failed to save lockfile %s: %v", path, err)
+		}
+	}
+}
+
+// pruneLockFile drops flakes whose flake.nix is gone and the store paths
+// only they needed, logging each removal.
+func pruneLockFile(path string, lf *cache.LockFile) {
+	report := lf.Prune(func(label string) bool {
+		pkg, _, _ := strings.Cut(strings.TrimPrefix(label, "//"), ":")
+		_, err := os.Stat(filepath.Join(lf.Root, filepath.FromSlash(pkg), "flake.nix"))
+		return !os.IsNotExist(err)
+	})
+	for _, label := range report.Flakes {
+		log.Printf("Removed %s from %s: flake.nix no longer exists", label, path)
+	}
+	for _, p := range report.StorePaths {
+		log.Printf("Removed unreachable store path %s from %s", p, path)
+	}
+	if len(report.Flakes) > 0 || len(report.StorePaths) > 0 {
+		log.Printf("Pruned %d flakes and %d store paths from %s", len(report.Flakes), len(report.StorePaths), path)
 	}
 }
 
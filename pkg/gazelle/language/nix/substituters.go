@@ -0,0 +1,70 @@
+package nix
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+// storeResolver looks up store paths for one configuration: the
+// substituters to query and the keys their narinfo must be signed with.
+type storeResolver struct {
+	client      *cache.Cache
+	trustedKeys cache.TrustedKeys
+	crawler     *closureCrawler
+}
+
+// resolverFor returns the storeResolver for cfg, reusing it across
+// directories that share the same substituter, trust and crawl settings.
+func (l *nixLang) resolverFor(cfg *NixConfig) *storeResolver {
+	key := fmt.Sprintf("%s|%s|%s|%d",
+		cfg.NarInfoCacheDir,
+		strings.Join(cfg.Substituters, " "),
+		strings.Join(cfg.TrustedPublicKeys, " "),
+		cfg.CrawlConcurrency)
+	for _, url := range cfg.Substituters {
+		key += "|" + strings.Join(cfg.SubstituterMirrors[url], " ")
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if res, ok := l.resolvers[key]; ok {
+		return res
+	}
+
+	trustedKeys, err := cache.ParseTrustedKeys(cfg.TrustedPublicKeys)
+	if err != nil {
+		log.Fatalf("invalid nix_trusted_public_keys: %v", err)
+	}
+
+	var subs []*cache.Substituter
+	for _, url := range cfg.Substituters {
+		subs = append(subs, &cache.Substituter{
+			URL:     url,
+			Mirrors: append([]string(nil), cfg.SubstituterMirrors[url]...),
+		})
+	}
+	client := cache.NewWithSubstituters(subs)
+	client.Credentials = cfg.Credentials
+	if cfg.NarInfoCacheDir != "" {
+		client.DiskCache = cache.NewNarInfoDiskCache(cfg.NarInfoCacheDir)
+	}
+
+	res := &storeResolver{client: client, trustedKeys: trustedKeys}
+	// Untrusted narinfo is passed over in favour of the next substituter.
+	client.Verify = res.verify
+	res.crawler = newClosureCrawler(res, cfg.CrawlConcurrency)
+	l.resolvers[key] = res
+	return res
+}
+
+// verify rejects narinfo that is not signed by a trusted key.
+func (r *storeResolver) verify(info *cache.NarInfo) error {
+	if err := r.trustedKeys.Verify(info); err != nil {
+		return fmt.Errorf("rejecting narinfo from %s: %w", info.CacheURL, err)
+	}
+	return nil
+}
@@ -1,20 +1,22 @@
 package sandbox
 
 import (
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
+	"hash"
 	"io"
 	"net/http"
 	"os"
 	"os/exec"
 	"strings"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
 )
 
-// HandleBuiltin simulates Nix builtin builders like fetchurl
-func HandleBuiltin(builder string, srcPath string, destPath string) error {
+// HandleBuiltin simulates Nix builtin builders like fetchurl. env holds
+// the builder's parameters, as the derivation's environment would in Nix.
+func HandleBuiltin(builder string, srcPath string, destPath string, env map[string]string) error {
 	if strings.HasPrefix(builder, "builtin:fetchurl") {
-		return handleFetchUrl(srcPath, destPath)
+		return handleFetchUrl(srcPath, destPath, env)
 	}
 	// Default fallback: local copy
 	// Used when builder is "builtin:interaction" or just local simulation
@@ -30,16 +32,27 @@ func handleLocalCopy(src, dest string) error {
 	return nil
 }
 
-func handleFetchUrl(src, dest string) error {
+func handleFetchUrl(src, dest string, env map[string]string) error {
 	// Check environment variables passed by Nix
-	url := os.Getenv("url")
-	urls := os.Getenv("urls")
-	outputHash := os.Getenv("outputHash")
+	url := env["url"]
+	urls := env["urls"]
+	outputHash := env["outputHash"]
 
 	if url == "" && urls == "" {
 		return fmt.Errorf("builtin:fetchurl failed: no url provided for %s", src)
 	}
 
+	// outputHash may be SRI, "<algo>:<digest>", or a bare base16, base32 or
+	// base64 digest of outputHashAlgo.
+	var expected cache.Hash
+	if outputHash != "" {
+		h, err := cache.ParseHashWithAlgorithm(outputHash, env["outputHashAlgo"])
+		if err != nil {
+			return fmt.Errorf("builtin:fetchurl failed: %w", err)
+		}
+		expected = h
+	}
+
 	var candidates []string
 	if url != "" {
 		candidates = append(candidates, url)
@@ -71,10 +84,17 @@ func handleFetchUrl(src, dest string) error {
 			return fmt.Errorf("failed to create output file %s: %v", dest, err)
 		}
 
-		hasher := sha256.New()
-		multi := io.MultiWriter(outF, hasher)
+		var w io.Writer = outF
+		var hasher hash.Hash
+		if outputHash != "" {
+			if hasher, err = cache.NewHasher(expected.Algorithm); err != nil {
+				outF.Close()
+				return fmt.Errorf("builtin:fetchurl failed: %w", err)
+			}
+			w = io.MultiWriter(outF, hasher)
+		}
 
-		if _, err := io.Copy(multi, resp.Body); err != nil {
+		if _, err := io.Copy(w, resp.Body); err != nil {
 			outF.Close()
 			fmt.Printf("WARNING: Download interrupted for %s: %v\n", u, err)
 			continue
@@ -82,21 +102,11 @@ func handleFetchUrl(src, dest string) error {
 		outF.Close()
 
 		// Verify Hash
-		if outputHash != "" {
-			sum := hasher.Sum(nil)
-			// Expect SRI sha256-...
-			if strings.HasPrefix(outputHash, "sha256-") {
-				encoded := strings.TrimPrefix(outputHash, "sha256-")
-				dec, err := base64.StdEncoding.DecodeString(encoded)
-				if err != nil {
-					return fmt.Errorf("failed to decode SRI hash %s: %v", outputHash, err)
-				}
-				if string(sum) != string(dec) {
-					fmt.Printf("WARNING: Hash mismatch for %s. Expected %x, got %x\n", u, dec, sum)
-					continue
-				}
-			} else {
-				fmt.Printf("WARNING: Unsupported hash format %s, skipping verification\n", outputHash)
+		if hasher != nil {
+			actual := cache.Hash{Algorithm: expected.Algorithm, Digest: hasher.Sum(nil)}
+			if !actual.Equal(expected) {
+				fmt.Printf("WARNING: Hash mismatch for %s. Expected %s, got %s\n", u, expected.SRI(), actual.SRI())
+				continue
 			}
 		}
 		return nil // Success
@@ -6,6 +6,8 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
 )
 
 // SandboxConfig defines the configuration for the bwrap sandbox
@@ -23,6 +25,17 @@ type SandboxConfig struct {
 
 	// Explicit list of host paths to mount (e.g. .cache)
 	AdditionalRoBinds []string
+
+	// Symlinks maps sandbox paths to symlink targets, created after all
+	// mounts. A symlink inside a mount needs that mount in Layered.
+	Symlinks map[string]string
+
+	// Layered lists directory mounts (by sandbox path) that are rebuilt on
+	// a tmpfs instead of bound whole, so symlinks can be added to them:
+	// the directories leading to a symlink are created, everything else is
+	// bound read-only entry by entry, and the tmpfs is made read-only once
+	// the symlinks are in place. Symlink manifests are left out.
+	Layered map[string]bool
 }
 
 // StandardSetup adds standard mounts and enables namespaces.
@@ -50,6 +63,41 @@ func (c *SandboxConfig) StandardSetup(mountSystemLibs bool) error {
 	return nil
 }
 
+// RestoreStoreSymlinks arranges for the symlinks recorded in the symlink
+// manifests (see cache.SymlinkManifestName) of mounted /nix/store paths to
+// be recreated inside the sandbox.
+func (c *SandboxConfig) RestoreStoreSymlinks() error {
+	for s, host := range c.Mounts {
+		if !strings.HasPrefix(s, "/nix/store/") {
+			continue
+		}
+		links, err := cache.ReadSymlinkManifest(host)
+		if err != nil {
+			return err
+		}
+		if len(links) == 0 {
+			continue
+		}
+		if c.Symlinks == nil {
+			c.Symlinks = make(map[string]string)
+		}
+		if target, ok := links["."]; ok {
+			// The store path itself is a symlink.
+			delete(c.Mounts, s)
+			c.Symlinks[s] = target
+			continue
+		}
+		if c.Layered == nil {
+			c.Layered = make(map[string]bool)
+		}
+		c.Layered[s] = true
+		for rel, target := range links {
+			c.Symlinks[filepath.Join(s, filepath.FromSlash(rel))] = target
+		}
+	}
+	return nil
+}
+
 // BuildBwrapArgs constructs the bwrap command line arguments
 func BuildBwrapArgs(cfg *SandboxConfig) ([]string, error) {
 	var args []string
@@ -105,9 +153,33 @@ func BuildBwrapArgs(cfg *SandboxConfig) ([]string, error) {
 		if !strings.HasPrefix(s, "/bin/") && !strings.HasPrefix(s, "/usr/") {
 			args = append(args, "--dir", filepath.Dir(s))
 		}
+		if cfg.Layered[s] {
+			layerArgs, err := cfg.layerArgs(host, s)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, layerArgs...)
+			continue
+		}
 		args = append(args, "--ro-bind", host, s)
 	}
 
+	// Symlinks, parents first
+	var sortedSymlinks []string
+	for s := range cfg.Symlinks {
+		sortedSymlinks = append(sortedSymlinks, s)
+	}
+	sort.Strings(sortedSymlinks)
+
+	for _, s := range sortedSymlinks {
+		args = append(args, "--dir", filepath.Dir(s), "--symlink", cfg.Symlinks[s], s)
+	}
+	for _, s := range sortedSandbox {
+		if cfg.Layered[s] {
+			args = append(args, "--remount-ro", s)
+		}
+	}
+
 	// Additional binds
 	for _, p := range cfg.AdditionalRoBinds {
 		if _, err := os.Stat(p); err == nil {
@@ -118,6 +190,59 @@ func BuildBwrapArgs(cfg *SandboxConfig) ([]string, error) {
 	return args, nil
 }
 
+// layerArgs rebuilds the host directory host at s on a tmpfs, leaving room
+// for the symlinks under s; see SandboxConfig.Layered. Only bwrap options
+// every release supports are used.
+func (cfg *SandboxConfig) layerArgs(host, s string) ([]string, error) {
+	// Directories that lead to a symlink are created rather than bound.
+	expand := map[string]bool{s: true}
+	for p := range cfg.Symlinks {
+		if !strings.HasPrefix(p, s+"/") {
+			continue
+		}
+		for dir := filepath.Dir(p); dir != s && !expand[dir]; dir = filepath.Dir(dir) {
+			expand[dir] = true
+		}
+	}
+
+	args := []string{"--tmpfs", s}
+	var walk func(host, dir string) error
+	walk = func(host, dir string) error {
+		entries, err := os.ReadDir(host)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			hp, sp := filepath.Join(host, e.Name()), filepath.Join(dir, e.Name())
+			switch {
+			case dir == s && e.Name() == cache.SymlinkManifestName:
+				// Not part of the store path.
+			case cfg.Symlinks[sp] != "":
+				// Created with the other symlinks.
+			case expand[sp] && e.IsDir():
+				args = append(args, "--dir", sp)
+				if err := walk(hp, sp); err != nil {
+					return err
+				}
+			case e.Type()&os.ModeSymlink != 0:
+				// Binding would follow the link; recreate it instead.
+				target, err := os.Readlink(hp)
+				if err != nil {
+					return err
+				}
+				args = append(args, "--symlink", target, sp)
+			default:
+				args = append(args, "--ro-bind", hp, sp)
+			}
+		}
+		return nil
+	}
+	if err := walk(host, s); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
 // FindShell checks if a shell is configured in the mounts
 func FindShell(mounts map[string]string, builderPath string) bool {
 	// If builderPath provided and mapped, good
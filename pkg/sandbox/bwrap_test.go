@@ -0,0 +1,96 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+// storePath creates a store path tree under a temporary directory with the
+// given symlinks recorded in its manifest.
+func storePath(t *testing.T, links map[string]string) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "out")
+	for _, dir := range []string{"bin", "lib/pkgconfig"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"bin/hello", "lib/libhello.so", "lib/pkgconfig/hello.pc"} {
+		if err := os.WriteFile(filepath.Join(root, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("libhello.so", filepath.Join(root, "lib/libhello.so.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.PlaceSymlinks(root, links); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestRestoreStoreSymlinks(t *testing.T) {
+	const (
+		hello = "/nix/store/i3zw7h6pg3n9r5i63iyqxrapa70i4v5w-hello-2.12.2"
+		glibc = "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-glibc-2.40"
+		alias = "/nix/store/hlcdbvwjlzjd2x86fxghzj1gpzplccqw-hello-alias"
+		plain = "/nix/store/j193mfi0f921y0kfs8vjc1znnr45ispv-plain"
+	)
+	helloHost := storePath(t, map[string]string{"lib/libc.so.6": glibc + "/lib/libc.so.6"})
+	aliasHost := storePath(t, map[string]string{".": hello})
+	plainHost := storePath(t, nil)
+
+	cfg := &SandboxConfig{Mounts: map[string]string{hello: helloHost, alias: aliasHost, plain: plainHost}}
+	if err := cfg.RestoreStoreSymlinks(); err != nil {
+		t.Fatal(err)
+	}
+	wantSymlinks := map[string]string{
+		hello + "/lib/libc.so.6": glibc + "/lib/libc.so.6",
+		alias:                    hello,
+	}
+	if !reflect.DeepEqual(cfg.Symlinks, wantSymlinks) {
+		t.Errorf("Symlinks = %v; want %v", cfg.Symlinks, wantSymlinks)
+	}
+	if !reflect.DeepEqual(cfg.Layered, map[string]bool{hello: true}) {
+		t.Errorf("Layered = %v; want only %s", cfg.Layered, hello)
+	}
+	if _, ok := cfg.Mounts[alias]; ok {
+		t.Errorf("store path that is itself a symlink is still mounted")
+	}
+
+	args, err := BuildBwrapArgs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Join(args, " ")
+	for _, want := range []string{
+		"--ro-bind " + plainHost + " " + plain,
+		"--tmpfs " + hello,
+		"--ro-bind " + helloHost + "/bin " + hello + "/bin",
+		"--dir " + hello + "/lib",
+		"--ro-bind " + helloHost + "/lib/libhello.so " + hello + "/lib/libhello.so",
+		"--ro-bind " + helloHost + "/lib/pkgconfig " + hello + "/lib/pkgconfig",
+		"--symlink libhello.so " + hello + "/lib/libhello.so.1",
+		"--symlink " + glibc + "/lib/libc.so.6 " + hello + "/lib/libc.so.6",
+		"--symlink " + hello + " " + alias,
+		"--remount-ro " + hello,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("bwrap args lack %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, cache.SymlinkManifestName) {
+		t.Errorf("bwrap args expose the symlink manifest:\n%s", got)
+	}
+	if strings.Contains(got, "overlay") {
+		t.Errorf("bwrap args need overlay support:\n%s", got)
+	}
+	if strings.Index(got, "--remount-ro "+hello) < strings.Index(got, "--symlink "+glibc) {
+		t.Errorf("tmpfs is made read-only before the symlinks are created:\n%s", got)
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
 )
 
-// Copier handles copying files and directories while resolving /nix/store symlinks
+// Copier handles copying files and directories out of the sandbox
 type Copier struct {
 	// Mounts maps sandbox paths to their actual host paths
 	Mounts map[string]string
@@ -19,25 +21,36 @@ func NewCopier(mounts map[string]string) *Copier {
 	return &Copier{Mounts: mounts}
 }
 
-// CopyRecursive copies src to dst, resolving any /nix/store symlinks using the mounts map
+// CopyRecursive copies src to dst. Symlinks into /nix/store, and those whose
+// targets do not exist, are not copied but recorded in dst's symlink
+// manifest (see cache.SymlinkManifestName), so dst stays a valid Bazel tree
+// artifact that the sandbox can restore faithfully.
 func (c *Copier) CopyRecursive(src, dst string) error {
+	symlinks := make(map[string]string)
+	if err := c.copy(src, dst, dst, symlinks); err != nil {
+		return err
+	}
+	return cache.PlaceSymlinks(dst, symlinks)
+}
+
+func (c *Copier) copy(src, dst, root string, symlinks map[string]string) error {
 	info, err := os.Lstat(src)
 	if err != nil {
 		return err
 	}
 
 	if info.IsDir() {
-		return c.copyDir(src, dst)
+		return c.copyDir(src, dst, root, symlinks)
 	}
 
 	if info.Mode()&os.ModeSymlink != 0 {
-		return c.copySymlink(src, dst)
+		return c.copySymlink(src, dst, root, symlinks)
 	}
 
 	return c.copyFile(src, dst, info.Mode())
 }
 
-func (c *Copier) copyDir(src, dst string) error {
+func (c *Copier) copyDir(src, dst, root string, symlinks map[string]string) error {
 	if err := os.MkdirAll(dst, 0755); err != nil {
 		return err
 	}
@@ -46,38 +59,32 @@ func (c *Copier) copyDir(src, dst string) error {
 		return err
 	}
 	for _, entry := range entries {
-		if err := c.CopyRecursive(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+		if err := c.copy(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), root, symlinks); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (c *Copier) copySymlink(src, dst string) error {
+// copySymlink records the symlink src for cache.PlaceSymlinks rather than
+// creating it, keyed by the path of dst relative to root.
+func (c *Copier) copySymlink(src, dst, root string, symlinks map[string]string) error {
 	target, err := os.Readlink(src)
 	if err != nil {
 		return err
 	}
 
-	// If symlink points to /nix/store, try to resolve via mounts and copy content
-	if strings.HasPrefix(target, "/nix/store/") {
-		hostTarget := c.resolveNixStorePath(target)
-		if hostTarget != "" {
-			targetInfo, err := os.Stat(hostTarget)
-			if err == nil {
-				if targetInfo.IsDir() {
-					return c.CopyRecursive(hostTarget, dst)
-				}
-				return c.copyFile(hostTarget, dst, targetInfo.Mode())
-			}
-			fmt.Printf("WARNING: Found mount for %s -> %s but stat failed: %v\n", target, hostTarget, err)
-		} else {
-			fmt.Printf("WARNING: Cannot resolve /nix/store symlink %s (not in mounts map)\n", target)
-		}
+	// The sandbox can only restore /nix/store symlinks to paths it mounts.
+	if strings.HasPrefix(target, "/nix/store/") && c.resolveNixStorePath(target) == "" {
+		fmt.Printf("WARNING: /nix/store symlink %s -> %s is not in the mounts map\n", src, target)
 	}
 
-	// Keep symlink as-is for non /nix/store targets or if resolution failed
-	return os.Symlink(target, dst)
+	rel, err := filepath.Rel(root, dst)
+	if err != nil {
+		return err
+	}
+	symlinks[filepath.ToSlash(rel)] = target
+	return nil
 }
 
 // resolveNixStorePath looks up a /nix/store path in the mounts map and returns the host path
@@ -0,0 +1,56 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/JonathanPerry651/nix-bazel-via-bwrap/cache"
+)
+
+func TestCopyRecursive(t *testing.T) {
+	const glibc = "/nix/store/kywwgk85nl83mpf10av3bvm2khdlq5ib-glibc-2.40"
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "lib/libhello.so"), []byte("elf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"lib/libhello.so.1": "libhello.so",
+		"lib/libc.so.6":     glibc + "/lib/libc.so.6",
+		"lib/dangling":      "missing",
+	} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dst := filepath.Join(t.TempDir(), "out")
+	c := NewCopier(map[string]string{glibc: "/host/glibc"})
+	if err := c.CopyRecursive(src, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := os.Stat(filepath.Join(dst, "lib/libhello.so")); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("copied file: %v, %v", info, err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "lib/libhello.so.1")); err != nil || target != "libhello.so" {
+		t.Errorf("relative symlink = %q, %v", target, err)
+	}
+	for _, link := range []string{"lib/libc.so.6", "lib/dangling"} {
+		if _, err := os.Lstat(filepath.Join(dst, link)); !os.IsNotExist(err) {
+			t.Errorf("%s was created: %v", link, err)
+		}
+	}
+	links, err := cache.ReadSymlinkManifest(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"lib/libc.so.6": glibc + "/lib/libc.so.6", "lib/dangling": "missing"}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("manifest = %v; want %v", links, want)
+	}
+}
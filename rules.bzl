@@ -316,6 +316,10 @@ def _nix_nar_unpack_impl(ctx):
     args.add("-src", ctx.file.src)
     args.add("-dest", out.path)
     args.add("-compression", ctx.attr.compression)
+    if ctx.attr.nar_hash:
+        args.add("-nar-hash", ctx.attr.nar_hash)
+    if ctx.attr.nar_size:
+        args.add("-nar-size", ctx.attr.nar_size)
     
     ctx.actions.run(
         outputs = [out],
@@ -363,7 +367,10 @@ nix_nar_unpack = rule(
         "src": attr.label(allow_single_file = True, mandatory = True),
         "deps": attr.label_list(providers = [NixInfo]),
         "store_path": attr.string(doc = "Absolute /nix/store path this output corresponds to"),
-        "compression": attr.string(default = "xz", values = ["xz", "bzip2", "none"]),
+        "compression": attr.string(default = "bzip2", values = ["none", "xz", "bzip2", "zstd", "gzip", "br", "lzip"]),
+        "nar_hash": attr.string(doc = "Expected hash of the decompressed NAR (narinfo NarHash); verified while unpacking"),
+        # A string, since attr.int is 32-bit and NARs can exceed 2 GiB.
+        "nar_size": attr.string(doc = "Expected size in bytes of the decompressed NAR (narinfo NarSize), in decimal; verified while unpacking"),
         "_tool": attr.label(
             default = Label("@nix_bazel_via_bwrap//cmd/nix_tool"),
             executable = True,